@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon.v2"
+)
+
+// AllowAddresses restricts the macaroon to be used only from the given
+// networks, given either in CIDR notation or as single IP addresses. If
+// macaroon already has allowed networks, request address should belong to
+// both lists.
+func AllowAddresses(m *macaroon.Macaroon, networks []string) (
+	*macaroon.Macaroon, error) {
+
+	value := strings.Join(networks, ",")
+	if err := checkAddressesCaveat(value); err != nil {
+		return nil, err
+	}
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(AllowedAddressPrefix, value)
+}
+
+type peerAddressKey struct{}
+
+// ContextWithPeerAddress returns the context which contains the address from
+// which request has been made, address might be given either with or without
+// the port, e.g. as http.Request.RemoteAddr.
+func ContextWithPeerAddress(ctx context.Context,
+	address string) context.Context {
+
+	return context.WithValue(ctx, peerAddressKey{}, address)
+}
+
+// PeerAddressFromContext returns the IP address from which request has been
+// made, nil is returned if address is not known.
+func PeerAddressFromContext(ctx context.Context) net.IP {
+	address, ok := ctx.Value(peerAddressKey{}).(string)
+	if !ok {
+		return nil
+	}
+
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	return net.ParseIP(address)
+}
+
+// checkPeerAddress checks that request has been made from the network
+// allowed by the macaroon. If macaroon is restricted to the networks, but
+// peer address is unknown, request is rejected.
+func checkPeerAddress(ctx context.Context, m *macaroon.Macaroon) error {
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		return err
+	}
+
+	allowedLists, err := md.GetAll(AllowedAddressPrefix)
+	if err == ErrFieldNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ip := PeerAddressFromContext(ctx)
+	if ip == nil {
+		return ErrAddressNotAllowed
+	}
+
+	for _, data := range allowedLists {
+		networks, err := parseNetworks(data)
+		if err != nil {
+			return err
+		}
+
+		if !containsAddress(networks, ip) {
+			return ErrAddressNotAllowed
+		}
+	}
+
+	return nil
+}
+
+func containsAddress(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNetworks parses the list of networks stored in the caveat, single IP
+// address is considered as the network of one address.
+func parseNetworks(data string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range splitOperations(data) {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("malformed address: %q", s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func checkAddressesCaveat(value string) error {
+	_, err := parseNetworks(value)
+	return err
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAllowedAddresses(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		AllowedAddresses([]string{"10.0.0.0/8", "2001:db8::/32"}))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Client narrows the token down to the single server.
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	m, err = AllowAddresses(m, []string{"10.1.2.3", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unable to allow addresses: %v", err)
+	}
+
+	narrowedStr, err := EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	steps := []struct {
+		address string
+		err     error
+	}{
+		{"", ErrAddressNotAllowed},
+		{"10.1.2.3:4567", nil},
+		{"10.1.2.4:4567", ErrAddressNotAllowed},
+		{"192.168.1.1", ErrAddressNotAllowed},
+		{"[2001:db8::1]:4567", nil},
+		{"2001:db9::1", ErrAddressNotAllowed},
+	}
+
+	for i, step := range steps {
+		ctx := context.Background()
+		if step.address != "" {
+			ctx = ContextWithPeerAddress(ctx, step.address)
+		}
+
+		_, err := auth.ExtractTokenContext(ctx, addFreshness(t, narrowedStr,
+			int64(i+1)))
+		if err != step.err {
+			t.Fatalf("(%v) wrong error for address %v: %v, expected %v", i,
+				step.address, err, step.err)
+		}
+	}
+
+	if _, err := AllowAddresses(m, []string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("malformed network should be rejected")
+	}
+}
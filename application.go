@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// UserID is the id of the user on whose behalf tokens are issued. It is either
+// numeric id, represented in the canonical decimal form, or opaque string,
+// such as UUID.
+type UserID string
+
+// NumericUserID returns the user id of the user with the given numeric id.
+func NumericUserID(id uint64) UserID {
+	return UserID(strconv.FormatUint(id, 10))
+}
+
+// Uint64 returns the numeric value of the user id, false is returned if user
+// id isn't in the canonical decimal form.
+func (id UserID) Uint64() (uint64, bool) {
+	v, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil || NumericUserID(v) != id {
+		return 0, false
+	}
+
+	return v, true
+}
+
+// Application is the third-party application, such as trading bot or wallet,
+// to which user grants the access on his behalf. Tokens are issued for the
+// application rather than for the user, so that tokens of different
+// applications could be distinguished.
+type Application struct {
+	// ID is the unique identifier of the application assigned by the
+	// database.
+	ID uint32
+
+	// Name is the human readable name of the application.
+	Name string
+
+	// UserID is the id of the user who owns the application.
+	UserID UserID
+
+	// CreatedAt is the time when application has been registered.
+	CreatedAt time.Time
+
+	// Description is the optional user provided description.
+	Description string
+}
+
+// RegisterApplication registers new application of the user, after that
+// tokens could be issued for it.
+func (a *Auth) RegisterApplication(userID UserID, name,
+	description string) (*Application, error) {
+
+	if userID == "" {
+		return nil, errors.Errorf("user id is empty")
+	}
+
+	app := &Application{
+		Name:        name,
+		UserID:      userID,
+		CreatedAt:   a.clock.Now(),
+		Description: description,
+	}
+
+	if err := a.db.PutApplication(app); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// GetApplication returns the registered application by its id.
+func (a *Auth) GetApplication(id uint32) (*Application, error) {
+	return a.db.GetApplication(id)
+}
+
+// GetUserApplications returns all applications registered by the user.
+func (a *Auth) GetUserApplications(userID UserID) ([]*Application, error) {
+	return a.db.GetUserApplications(userID)
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"math"
+	"testing"
+)
+
+func TestApplicationRegistry(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	app, err := auth.RegisterApplication("100", "bot", "trading bot")
+	if err != nil {
+		t.Fatalf("unable to register application: %v", err)
+	}
+
+	if app.ID == 0 {
+		t.Fatalf("application id should be non-zero")
+	}
+
+	if _, err := auth.RegisterApplication("200", "wallet", ""); err != nil {
+		t.Fatalf("unable to register application: %v", err)
+	}
+
+	storedApp, err := auth.GetApplication(app.ID)
+	if err != nil {
+		t.Fatalf("unable to get application: %v", err)
+	}
+
+	if storedApp.Name != "bot" || storedApp.UserID != "100" ||
+		storedApp.Description != "trading bot" {
+		t.Fatalf("wrong application: %v", storedApp)
+	}
+
+	apps, err := auth.GetUserApplications("100")
+	if err != nil {
+		t.Fatalf("unable to get user applications: %v", err)
+	}
+
+	if len(apps) != 1 || apps[0].ID != app.ID {
+		t.Fatalf("wrong user applications: %v", apps)
+	}
+
+	if _, err := auth.GetApplication(100); err != ErrApplicationNotFound {
+		t.Fatalf("expected application not found error: %v", err)
+	}
+
+	_, err = auth.GenerateToken("100", 100, nil)
+	if err != ErrApplicationNotFound {
+		t.Fatalf("token for unknown application shouldn't be issued: %v",
+			err)
+	}
+
+	// Token for the application of another user shouldn't be issued.
+	_, err = auth.GenerateToken("200", app.ID, nil)
+	if err != ErrApplicationNotFound {
+		t.Fatalf("token for application of another user shouldn't be "+
+			"issued: %v", err)
+	}
+}
+
+func TestApplicationTokens(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	firstAppID := registerApplication(t, auth, "100")
+	secondAppID := registerApplication(t, auth, "100")
+
+	for _, appID := range []uint32{firstAppID, secondAppID} {
+		tokenStr, err := auth.GenerateToken("100", appID, nil)
+		if err != nil {
+			t.Fatalf("unable to generate macaroon token: %v", err)
+		}
+
+		token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+		if err != nil {
+			t.Fatalf("unable to extract token: %v", err)
+		}
+
+		if token.ApplicationID() != appID {
+			t.Fatalf("wrong application id: %v, expected %v",
+				token.ApplicationID(), appID)
+		}
+
+		if token.UserID() != "100" {
+			t.Fatalf("wrong user id: %v", token.UserID())
+		}
+	}
+}
+
+func TestUserID(t *testing.T) {
+	steps := []struct {
+		userID  UserID
+		value   uint64
+		numeric bool
+	}{
+		{"100", 100, true},
+		{NumericUserID(math.MaxUint64), math.MaxUint64, true},
+		{"007", 0, false},
+		{"-1", 0, false},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", 0, false},
+	}
+
+	for _, step := range steps {
+		value, numeric := step.userID.Uint64()
+		if value != step.value || numeric != step.numeric {
+			t.Fatalf("(%v) wrong numeric value: %v, %v", step.userID,
+				value, numeric)
+		}
+	}
+}
+
+func TestStringUserID(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	if _, err := auth.RegisterApplication("", "bot", ""); err == nil {
+		t.Fatalf("application without user shouldn't be registered")
+	}
+
+	userID := UserID("0f8fad5b-d9cb-469f-a165-70867728950e")
+	appID := registerApplication(t, auth, userID)
+
+	tokenStr, err := auth.GenerateToken(userID, appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if token.UserID() != userID {
+		t.Fatalf("wrong user id: %v, expected %v", token.UserID(), userID)
+	}
+
+	if err := auth.RevokeAllForUser(userID); err != nil {
+		t.Fatalf("unable to revoke user tokens: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, tokenStr, 2))
+	if err != ErrTokenRevoked {
+		t.Fatalf("revoked token should be rejected: %v", err)
+	}
+}
@@ -1,67 +1,458 @@
 package auth
 
 import (
-	"strconv"
-	"encoding/binary"
+	"time"
 	"gopkg.in/macaroon.v2"
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 )
 
 const (
 	UserPrefix              = "user"
 	NoncePrefix             = "nonce"
 	DisabledOperationPrefix = "disops"
+	AllowedOperationPrefix  = "allowops"
 	TimePrefix              = "time"
+	ExpiresPrefix           = "expires"
+	NotBeforePrefix         = "notbefore"
+	LifetimePrefix          = "lifetime"
+	AllowedResourcePrefix   = "resources"
+	AmountLimitPrefix       = "maxamount"
+	DailyQuotaPrefix        = "dailyquota"
+	AllowedAddressPrefix    = "ip"
+	RequestPrefix           = "request"
 )
 
 // Auth is an application authenticator which implements the auth.
 // Auth and used for issuing and checking the validity of third-party tokens.
 // Third-party token usually is used by trading bots, and wallet applications,
-// they not have expiration time, but do have a set of permitted operations,
+// by default they not have expiration time, unless it is given on token
+// generation, but do have a set of permitted operations,
 // which might be or might be not restricted down to read operations,
 // or info operations. This type of token by default do not have a right to
 // issue another applications tokens.
 type Auth struct {
-	rootKey  []byte
 	db       DB
 	location string
 
-	// TODO(andrew.shvv) Add token revocation.
+	// keyGracePeriod is the period of time during which tokens signed
+	// with the retired root key are still accepted.
+	keyGracePeriod time.Duration
+
+	// replayMode defines how the nonce of the token is checked for reuse.
+	replayMode ReplayMode
+
+	// nonceWindowSize is the size of the window in SlidingWindowNonce
+	// replay mode.
+	nonceWindowSize uint
+
+	// clock is used to obtain the current time.
+	clock Clock
+
+	// lifetime is the default period of time during which request made
+	// with the token remains fresh.
+	lifetime time.Duration
+
+	// maxClockSkew is the maximum tolerated difference between client and
+	// server clocks.
+	maxClockSkew time.Duration
+
+	// allowUnknownCaveats is true if caveats which are not interpreted by
+	// the auth should be ignored instead of token rejection.
+	allowUnknownCaveats bool
+
+	// requireRequestBinding is true if tokens which are not bound to the
+	// request should be rejected.
+	requireRequestBinding bool
+
+	// thirdPartyKeys are the keys shared with third-party services indexed
+	// by their location.
+	thirdPartyKeys map[string]*[32]byte
+
+	// caveatCheckers are the checkers of application-specific caveats
+	// indexed by the caveat key.
+	caveatCheckers map[string]CaveatChecker
+}
+
+// DefaultKeyGracePeriod is the default period of time during which tokens
+// signed with the retired root key are still accepted.
+var DefaultKeyGracePeriod = 24 * time.Hour
+
+// Option is used to change the default behaviour of the auth.
+type Option func(*Auth)
+
+// KeyGracePeriod sets the period of time after the root key rotation during
+// which tokens signed with the previous key are still accepted. After this
+// period clients have to obtain new tokens.
+func KeyGracePeriod(period time.Duration) Option {
+	return func(a *Auth) {
+		a.keyGracePeriod = period
+	}
+}
+
+// NonceReplayMode sets how the nonce of the token is checked for reuse, by
+// default nonce is only checked for exact match with previously used ones.
+func NonceReplayMode(mode ReplayMode) Option {
+	return func(a *Auth) {
+		a.replayMode = mode
+	}
+}
+
+// NonceWindowSize sets the number of nonces below the last accepted one,
+// which are accepted in SlidingWindowNonce replay mode if they haven't been
+// used.
+func NonceWindowSize(size uint) Option {
+	return func(a *Auth) {
+		a.nonceWindowSize = size
+	}
+}
+
+// TimeSource sets the clock which is used to obtain the current time, by
+// default system time is used.
+func TimeSource(clock Clock) Option {
+	return func(a *Auth) {
+		a.clock = clock
+	}
+}
+
+// RequestLifetime sets the default period of time during which request made
+// with the token remains fresh, by default MacaroonLifetime is used. Lifetime
+// might be overridden for the particular token on its generation. Nonces of
+// the request are kept by the database until request expiration.
+func RequestLifetime(lifetime time.Duration) Option {
+	return func(a *Auth) {
+		a.lifetime = lifetime
+	}
+}
+
+// MaxClockSkew sets the maximum tolerated difference between client and
+// server clocks. Tokens which time is further in the future are rejected,
+// and the same tolerance is added to the token expiration.
+func MaxClockSkew(skew time.Duration) Option {
+	return func(a *Auth) {
+		a.maxClockSkew = skew
+	}
+}
+
+// AllowUnknownCaveats turns on the compatibility mode, in which tokens with
+// caveats unknown to the auth are accepted and such caveats are ignored.
+//
+// NOTE: Ignored caveat might be the restriction which client expects to be
+// enforced, so this mode should be used only during the migration.
+func AllowUnknownCaveats() Option {
+	return func(a *Auth) {
+		a.allowUnknownCaveats = true
+	}
+}
+
+// RequireRequestBinding makes the auth to reject tokens which haven't been
+// bound to the request with BindRequest. Request should be passed to
+// ExtractTokenContext with ContextWithRequest.
+func RequireRequestBinding() Option {
+	return func(a *Auth) {
+		a.requireRequestBinding = true
+	}
+}
+
+// CaveatCheckers registers the checkers of application-specific caveats, which
+// are evaluated on token extraction and authorization. Caveat of the checker
+// couldn't be repeated in the token, and keys of the caveats interpreted by
+// the auth itself couldn't be registered.
+func CaveatCheckers(checkers ...CaveatChecker) Option {
+	return func(a *Auth) {
+		for _, checker := range checkers {
+			a.caveatCheckers[checker.Condition()] = checker
+		}
+	}
 }
 
 // NewAuth creates new instance of application auth.
-func NewAuth(location string, db DB) (*Auth, error) {
-	rootKey, err := db.GetRootKey()
+func NewAuth(location string, db DB, opts ...Option) (*Auth, error) {
+	// Check that database is initialised with the root key, root key itself
+	// is read from the database on every operation so that key rotation
+	// takes effect without restart of the service.
+	if _, err := db.GetRootKey(); err != nil {
+		return nil, err
+	}
+
+	a := &Auth{
+		db:              db,
+		location:        location,
+		keyGracePeriod:  DefaultKeyGracePeriod,
+		replayMode:      ExactNonceMatch,
+		nonceWindowSize: DefaultNonceWindowSize,
+		clock:           SystemClock,
+		lifetime:        MacaroonLifetime,
+		maxClockSkew:    DefaultMaxClockSkew,
+		caveatCheckers:  make(map[string]CaveatChecker),
+		thirdPartyKeys:  make(map[string]*[32]byte),
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	for condition := range a.caveatCheckers {
+		if _, ok := knownCaveats[condition]; ok {
+			return nil, errors.Errorf("caveat %q is reserved", condition)
+		}
+	}
+
+	return a, nil
+}
+
+// getVerificationKey returns the root key with which macaroon with the given
+// identifier should have been signed. Retired keys are returned only within
+// the grace period.
+func (a *Auth) getVerificationKey(id *identifier) (*RootKey, error) {
+	key, err := a.db.GetRootKeyByID(id.keyID)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Auth{
-		db:       db,
-		location: location,
-		rootKey:  rootKey,
-	}, nil
+	if key.IsRetired() &&
+		a.clock.Now().After(key.RetiredAt.Add(a.keyGracePeriod)) {
+		return nil, ErrRootKeyRetired
+	}
+
+	return key, nil
+}
+
+// tokenOptions is the set of optional constraints of the generated token.
+type tokenOptions struct {
+	// allowedOperations is the list of operations permitted to the token,
+	// nil means that all operations are permitted.
+	allowedOperations []string
+
+	// allowedResources is the list of resources permitted to the token, nil
+	// means that all resources are permitted.
+	allowedResources []string
+
+	// allowedAddresses is the list of networks from which token could be
+	// used, nil means that token could be used from any address.
+	allowedAddresses []string
+
+	// amountLimits are the limits of amount of the single operation.
+	amountLimits []limit
+
+	// dailyQuotas are the limits of amount spent within the day.
+	dailyQuotas []limit
+
+	// caveats are the application-specific caveats of the token.
+	caveats [][2]string
+
+	// thirdPartyCaveats are the caveats which should be discharged by
+	// third-party services.
+	thirdPartyCaveats []thirdPartyCaveat
+
+	// expiresAt is the time after which token is not valid, zero means
+	// that token doesn't expire.
+	expiresAt time.Time
+
+	// notBefore is the time before which token is not valid yet.
+	notBefore time.Time
+
+	// lifetime overrides the default request freshness lifetime, zero means
+	// that default lifetime of the auth is used.
+	lifetime time.Duration
+}
+
+// TokenOption is used to add optional constraints to the generated token.
+type TokenOption func(*tokenOptions)
+
+// AllowedOperations restricts the token to the given operations, so that
+// operations added to the api later are not granted to the token
+// automatically. Disabled operations are still applied on top of the allowed
+// ones.
+func AllowedOperations(ops []string) TokenOption {
+	return func(o *tokenOptions) {
+		// Nil list is kept as is, so that it leaves all operations
+		// permitted rather than none of them.
+		if ops == nil {
+			o.allowedOperations = nil
+			return
+		}
+
+		o.allowedOperations = append([]string{}, ops...)
+	}
+}
+
+// AllowedResources restricts the token to the given resources, e.g.
+// sub-accounts or wallets, such token is authorized only by IsAuthorizedFor.
+func AllowedResources(resources []string) TokenOption {
+	return func(o *tokenOptions) {
+		o.allowedResources = append([]string{}, resources...)
+	}
+}
+
+// AllowedAddresses restricts the token to be used only from the given
+// networks, e.g. whitelisted servers of the customer. Peer address should be
+// passed to ExtractTokenContext with ContextWithPeerAddress.
+func AllowedAddresses(networks []string) TokenOption {
+	return func(o *tokenOptions) {
+		o.allowedAddresses = append([]string{}, networks...)
+	}
+}
+
+// AmountLimit restricts the amount which could be spent by the single
+// operation matching the given pattern, it is checked by Token.CheckLimit.
+func AmountLimit(operation string, amount uint64) TokenOption {
+	return func(o *tokenOptions) {
+		o.amountLimits = append(o.amountLimits, limit{
+			operation: operation,
+			amount:    amount,
+		})
+	}
+}
+
+// DailyQuota restricts the total amount which could be spent by the
+// operations matching the given pattern within the day, it is checked by
+// Token.CheckLimit. Quota is shared by the token and its child tokens, but
+// quotas given to the sibling child tokens are counted separately.
+func DailyQuota(operation string, amount uint64) TokenOption {
+	return func(o *tokenOptions) {
+		o.dailyQuotas = append(o.dailyQuotas, limit{
+			operation: operation,
+			amount:    amount,
+		})
+	}
+}
+
+// ApplicationCaveat adds the application-specific caveat to the token, the
+// checker of the caveat should be registered with CaveatCheckers option.
+func ApplicationCaveat(key, value string) TokenOption {
+	return func(o *tokenOptions) {
+		o.caveats = append(o.caveats, [2]string{key, value})
+	}
+}
+
+// ThirdPartyCaveat makes the token valid only together with the discharge
+// issued by the third-party service located at the given location, which
+// checks the given condition, e.g. confirmation with the second factor. Key
+// of the third-party should be registered with ThirdPartyKey option.
+func ThirdPartyCaveat(location, condition string) TokenOption {
+	return func(o *tokenOptions) {
+		o.thirdPartyCaveats = append(o.thirdPartyCaveats, thirdPartyCaveat{
+			location:  location,
+			condition: condition,
+		})
+	}
+}
+
+// ExpiresAt limits the validity period of the token, after the given time
+// token is rejected with ErrTokenExpired.
+func ExpiresAt(t time.Time) TokenOption {
+	return func(o *tokenOptions) {
+		o.expiresAt = t
+	}
+}
+
+// NotBefore postpones the validity period of the token, before the given
+// time token is rejected with ErrTokenNotYetValid.
+func NotBefore(t time.Time) TokenOption {
+	return func(o *tokenOptions) {
+		o.notBefore = t
+	}
+}
+
+// TokenRequestLifetime overrides the period of time during which request made
+// with the token remains fresh, e.g. to give slow batch clients longer window
+// than interactive ones.
+func TokenRequestLifetime(lifetime time.Duration) TokenOption {
+	return func(o *tokenOptions) {
+		o.lifetime = lifetime
+	}
+}
+
+// GenerateRestrictedToken issues the token which is permitted to make only
+// the given operations, except disabled ones. Nil allowed operations permit
+// all operations, the same as GenerateToken does.
+func (a *Auth) GenerateRestrictedToken(userID UserID, applicationID uint32,
+	allowedOperations, disabledOperations []string) (string, error) {
+
+	return a.GenerateToken(userID, applicationID, disabledOperations,
+		AllowedOperations(allowedOperations))
 }
 
-// GenerateToken issues the token with the user id and operations
-// constraints, this token do not have a nonce and time by default,
-// so it could be used by client infinitely. Client in other hand is responsible
+// GenerateToken issues the token for the registered application with the
+// operations constraints, this token do not have a nonce and time by default,
+// so it could be used by client infinitely, unless ExpiresAt option is given.
+// Client in other hand is responsible
 // for adding the nonce and time constraints to ensure that even if token
 // will be intercepted by an attacker he/she couldn't use it for replay attack.
 // Token without nonce and time will be discarded during validation operation.
-func (a *Auth) GenerateToken(userID uint32,
-	disabledOperations []string) (string, error) {
+//
+// Application should be owned by the given user, otherwise
+// ErrApplicationNotFound is returned, so that user couldn't obtain the token
+// for the application of another user.
+func (a *Auth) GenerateToken(userID UserID, applicationID uint32,
+	disabledOperations []string, opts ...TokenOption) (string, error) {
 
-	// TODO(andrew.shvv) Use application id instead,
-	// but that would require some form of database.
-	var macaroonID [4]byte
-	binary.BigEndian.PutUint32(macaroonID[:], userID)
+	options := &tokenOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
 
-	m, err := macaroon.New(a.rootKey, macaroonID[:], a.location,
+	app, err := a.db.GetApplication(applicationID)
+	if err != nil {
+		return "", err
+	}
+
+	if app.UserID != userID {
+		return "", ErrApplicationNotFound
+	}
+
+	return a.issueToken(applicationID, app.UserID, nil, nil, nil,
+		disabledOperations, options)
+}
+
+// issueToken creates the token with the given lineage and numbers of quotas
+// introduced by its tokens, inherited caveats are added before the caveats
+// given in options.
+func (a *Auth) issueToken(applicationID uint32, userID UserID, lineage [][]byte,
+	lineageQuotas []uint32, inherited [][2]string, disabledOperations []string,
+	options *tokenOptions) (string, error) {
+
+	rootKey, err := a.db.GetRootKey()
+	if err != nil {
+		return "", err
+	}
+
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	id := &identifier{
+		keyID:         rootKey.ID,
+		applicationID: applicationID,
+		userID:        userID,
+		tokenID:       tokenID,
+		issuedAt:      a.clock.Now(),
+		lineage:       lineage,
+		lineageQuotas: lineageQuotas,
+	}
+
+	m, err := macaroon.New(rootKey.Key, id.encode(), a.location,
 		macaroon.LatestVersion)
 	if err != nil {
 		return "", err
 	}
 
+	for _, caveat := range inherited {
+		cav := checkers.Condition(caveat[0], caveat[1])
+		if err := m.AddFirstPartyCaveat([]byte(cav)); err != nil {
+			return "", err
+		}
+	}
+
+	if options.allowedOperations != nil {
+		m, err = AllowOperations(m, options.allowedOperations)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	if disabledOperations != nil {
 		m, err = DisableOperations(m, disabledOperations)
 		if err != nil {
@@ -69,18 +460,89 @@ func (a *Auth) GenerateToken(userID uint32,
 		}
 	}
 
+	if options.allowedResources != nil {
+		m, err = AllowResources(m, options.allowedResources)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if options.allowedAddresses != nil {
+		m, err = AllowAddresses(m, options.allowedAddresses)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, l := range options.amountLimits {
+		m, err = AddAmountLimit(m, l.operation, l.amount)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, l := range options.dailyQuotas {
+		m, err = AddDailyQuota(m, l.operation, l.amount)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, c := range options.thirdPartyCaveats {
+		key, ok := a.thirdPartyKeys[c.location]
+		if !ok {
+			return "", ErrThirdPartyNotFound
+		}
+
+		m, err = addThirdPartyCaveat(m, key, c.location, c.condition)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !options.expiresAt.IsZero() {
+		m, err = AddExpiration(m, options.expiresAt)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !options.notBefore.IsZero() {
+		m, err = AddNotBefore(m, options.notBefore)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if options.lifetime != 0 {
+		m, err = AddRequestLifetime(m, options.lifetime)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// Convert macaroon to check that it not contains any duplicate fields and
 	// also in order to put the user id in it.
 	md, err := NewMacaroonDictionary(m)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+
+	for _, caveat := range options.caveats {
+		if _, ok := a.caveatCheckers[caveat[0]]; !ok {
+			return "", ErrUnknownCaveat
+		}
+
+		if err := md.Put(caveat[0], caveat[1]); err != nil {
+			return "", err
+		}
 	}
 
 	// Put user id so that latter extract it from macaroon. As far as macaroon
 	// is signed and later validated by us with our root key we treat user id
-	// information as something which couldn't be changed.
-	userIDStr := strconv.FormatUint(uint64(userID), 10)
-	if err := md.Put(UserPrefix, userIDStr); err != nil {
+	// information as something which couldn't be changed. User id is always
+	// the last caveat added by us, all caveats after it are added by client.
+	if err := md.Put(UserPrefix, string(userID)); err != nil {
 		return "", err
 	}
 
@@ -1,15 +1,20 @@
 package auth
 
 import (
+	"encoding/binary"
 	"testing"
+	"time"
+
+	"gopkg.in/macaroon.v2"
 )
 
 func TestMacaroon(t *testing.T) {
 	auth, _ := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
 
-	// Emulate generation token on the server, with the user id taken from other
-	// token, for example jwt.
-	tokenStr, err := auth.GenerateToken(100, []string{"disabled"})
+	// Emulate generation token on the server, for the application registered
+	// by the user with the id taken from other token, for example jwt.
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, []string{"disabled"})
 	if err != nil {
 		t.Fatalf("unable to generate macaroon token: %v", err)
 	}
@@ -47,4 +52,455 @@ func TestMacaroon(t *testing.T) {
 	if err = token.IsAuthorized("disabled"); err != ErrOperNotAllowed {
 		t.Fatalf("operation should be not allowed")
 	}
+
+	if token.ApplicationID() != appID || token.UserID() != "100" {
+		t.Fatalf("wrong token principal: %v, %v", token.ApplicationID(),
+			token.UserID())
+	}
+}
+
+// registerApplication registers the test application of the user and
+// returns its id.
+func registerApplication(t *testing.T, auth *Auth, userID UserID) uint32 {
+	app, err := auth.RegisterApplication(userID, "bot", "trading bot")
+	if err != nil {
+		t.Fatalf("unable to register application: %v", err)
+	}
+
+	return app.ID
+}
+
+// addFreshness emulates the client which adds nonce and time caveats to the
+// token before making the request.
+func addFreshness(t *testing.T, tokenStr string, nonce int64) string {
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	m, err = AddNonce(m, nonce)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	m, err = AddCurrentTime(m)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	tokenStr, err = EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	return tokenStr
+}
+
+func TestRootKeyRotation(t *testing.T) {
+	db := NewInMemoryDB([]byte("kek"), MacaroonLifetime)
+	auth, err := NewAuth("", db)
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	oldToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	if err := db.PutRootKey([]byte("new kek")); err != nil {
+		t.Fatalf("unable to rotate root key: %v", err)
+	}
+
+	newToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Token signed with the retired key should be accepted within the grace
+	// period, new token should be signed with the new key.
+	if _, err := auth.ExtractToken(addFreshness(t, oldToken, 1)); err != nil {
+		t.Fatalf("old token should be accepted: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(addFreshness(t, newToken, 2)); err != nil {
+		t.Fatalf("new token should be accepted: %v", err)
+	}
+
+	m, _ := DecodeMacaroon(newToken)
+	id, err := decodeIdentifier(m.Id())
+	if err != nil {
+		t.Fatalf("unable to decode macaroon id: %v", err)
+	}
+
+	if id.keyID != 1 {
+		t.Fatalf("new token should be signed with key 1, got %v", id.keyID)
+	}
+
+	// After grace period old token should be rejected.
+	auth, err = NewAuth("", db, KeyGracePeriod(0))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, oldToken, 3))
+	if err != ErrRootKeyRetired {
+		t.Fatalf("old token should be rejected: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(addFreshness(t, newToken, 4)); err != nil {
+		t.Fatalf("new token should be accepted: %v", err)
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	// Emulate the token issued before identifier versioning, which id
+	// consists only of the user id.
+	var macaroonID [4]byte
+	binary.BigEndian.PutUint32(macaroonID[:], 100)
+
+	m, err := macaroon.New([]byte("kek"), macaroonID[:], "",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		t.Fatalf("unable to create dictionary: %v", err)
+	}
+
+	if err := md.Put(UserPrefix, "100"); err != nil {
+		t.Fatalf("unable to put user id: %v", err)
+	}
+
+	tokenStr, err := EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if token.UserID() != "100" || token.ApplicationID() != 0 ||
+		token.ID() != "" || token.KeyID() != 0 ||
+		!token.IssuedAt().IsZero() {
+		t.Fatalf("wrong legacy token: %v, %v, %v, %v, %v", token.UserID(),
+			token.ApplicationID(), token.ID(), token.KeyID(),
+			token.IssuedAt())
+	}
+}
+
+func TestTokenIdentifier(t *testing.T) {
+	db := NewInMemoryDB([]byte("kek"), MacaroonLifetime)
+	if err := db.PutRootKey([]byte("new kek")); err != nil {
+		t.Fatalf("unable to rotate root key: %v", err)
+	}
+
+	auth, err := NewAuth("", db)
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	before := time.Now()
+	tokenStr, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+	after := time.Now()
+
+	token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if token.KeyID() != 1 || token.IssuedAt().Before(before) ||
+		token.IssuedAt().After(after) || token.ID() == "" {
+		t.Fatalf("wrong token identifier: %v, %v, %v", token.KeyID(),
+			token.IssuedAt(), token.ID())
+	}
+}
+
+func TestReplayedToken(t *testing.T) {
+	modes := []ReplayMode{ExactNonceMatch, IncreasingNonce, SlidingWindowNonce}
+	for _, mode := range modes {
+		auth, err := NewAuth("", NewInMemoryDB([]byte("kek"),
+			MacaroonLifetime), NonceReplayMode(mode))
+		if err != nil {
+			t.Fatalf("unable to create auth: %v", err)
+		}
+
+		appID := registerApplication(t, auth, "100")
+		tokenStr, err := auth.GenerateToken("100", appID, nil)
+		if err != nil {
+			t.Fatalf("unable to generate macaroon token: %v", err)
+		}
+
+		tokenStr = addFreshness(t, tokenStr, 1)
+		if _, err := auth.ExtractToken(tokenStr); err != nil {
+			t.Fatalf("(%v) token should be accepted: %v", mode, err)
+		}
+
+		// Intercepted token shouldn't be accepted again.
+		if _, err := auth.ExtractToken(tokenStr); err == nil {
+			t.Fatalf("(%v) replayed token should be rejected", mode)
+		}
+	}
+}
+
+func TestRootKeyGracePeriod(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	auth, err := NewAuth("", db, KeyGracePeriod(time.Hour),
+		TimeSource(clock))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	if err := db.PutRootKey([]byte("new kek")); err != nil {
+		t.Fatalf("unable to rotate root key: %v", err)
+	}
+
+	extract := func(nonce int64) error {
+		m, err := DecodeMacaroon(tokenStr)
+		if err != nil {
+			t.Fatalf("unable to decode macaroon: %v", err)
+		}
+
+		m, err = AddNonce(m, nonce)
+		if err != nil {
+			t.Fatalf("unable to add nonce: %v", err)
+		}
+
+		m, err = AddCurrentTimeFrom(m, clock)
+		if err != nil {
+			t.Fatalf("unable to add current time: %v", err)
+		}
+
+		freshToken, err := EncodeMacaroon(m)
+		if err != nil {
+			t.Fatalf("unable to encode macaroon: %v", err)
+		}
+
+		_, err = auth.ExtractToken(freshToken)
+		return err
+	}
+
+	clock.Advance(time.Hour)
+	if err := extract(1); err != nil {
+		t.Fatalf("token should be accepted within grace period: %v", err)
+	}
+
+	clock.Advance(time.Nanosecond)
+	if err := extract(2); err != ErrRootKeyRetired {
+		t.Fatalf("token should be rejected after grace period: %v", err)
+	}
+}
+
+func TestRestrictedToken(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateRestrictedToken("100", appID,
+		[]string{"balance", "withdraw"}, []string{"withdraw"})
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if err := token.IsAuthorized("balance"); err != nil {
+		t.Fatalf("operation should be allowed: %v", err)
+	}
+
+	for _, op := range []string{"withdraw", "new_operation"} {
+		if err := token.IsAuthorized(op); err != ErrOperNotAllowed {
+			t.Fatalf("operation %v should be not allowed: %v", op, err)
+		}
+	}
+}
+
+func TestRestrictedTokenWithoutAllowList(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	// Nil allow list shouldn't restrict the token to no operations at all.
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateRestrictedToken("100", appID, nil,
+		[]string{"withdraw"})
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if err := token.IsAuthorized("balance"); err != nil {
+		t.Fatalf("operation should be allowed: %v", err)
+	}
+
+	if err := token.IsAuthorized("withdraw"); err != ErrOperNotAllowed {
+		t.Fatalf("operation should be not allowed: %v", err)
+	}
+}
+
+func TestRequestLifetime(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), time.Hour, clock)
+	auth, err := NewAuth("", db, TimeSource(clock), MaxClockSkew(0),
+		RequestLifetime(time.Second))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	interactiveToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	batchToken, err := auth.GenerateToken("100", appID, nil,
+		TokenRequestLifetime(time.Minute))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// extract emulates the request made with the given delay, client might
+	// add its own lifetime caveat.
+	extract := func(tokenStr string, nonce int64, delay,
+		clientLifetime time.Duration) error {
+
+		m, err := DecodeMacaroon(tokenStr)
+		if err != nil {
+			t.Fatalf("unable to decode macaroon: %v", err)
+		}
+
+		if clientLifetime != 0 {
+			m, err = AddRequestLifetime(m, clientLifetime)
+			if err != nil {
+				t.Fatalf("unable to add lifetime: %v", err)
+			}
+		}
+
+		m, err = AddNonce(m, nonce)
+		if err != nil {
+			t.Fatalf("unable to add nonce: %v", err)
+		}
+
+		m, err = AddCurrentTimeFrom(m, clock)
+		if err != nil {
+			t.Fatalf("unable to add current time: %v", err)
+		}
+
+		freshToken, err := EncodeMacaroon(m)
+		if err != nil {
+			t.Fatalf("unable to encode macaroon: %v", err)
+		}
+
+		clock.Advance(delay)
+		_, err = auth.ExtractToken(freshToken)
+		return err
+	}
+
+	steps := []struct {
+		tokenStr       string
+		delay          time.Duration
+		clientLifetime time.Duration
+		err            error
+	}{
+		{interactiveToken, time.Second, 0, nil},
+		{interactiveToken, 2 * time.Second, 0, ErrMacaroonExpired},
+		{batchToken, time.Minute, 0, nil},
+		{batchToken, 2 * time.Minute, 0, ErrMacaroonExpired},
+
+		// Client is able to shorten the lifetime but not to prolong it.
+		{batchToken, 2 * time.Second, time.Second, ErrMacaroonExpired},
+		{interactiveToken, 2 * time.Second, time.Minute, ErrMacaroonExpired},
+	}
+
+	for i, step := range steps {
+		err := extract(step.tokenStr, int64(i+1), step.delay,
+			step.clientLifetime)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+}
+
+func TestRequestLifetimeReplay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	auth, err := NewAuth("", db, TimeSource(clock))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		TokenRequestLifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	m, err = AddNonce(m, 1)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	m, err = AddCurrentTimeFrom(m, clock)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	freshToken, err := EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(freshToken); err != nil {
+		t.Fatalf("token should be accepted: %v", err)
+	}
+
+	// Flush nonces after the nonce lifetime of the database, captured
+	// request is still fresh and shouldn't be replayed.
+	db.StartFlushing()
+	defer db.StopFlushing()
+
+	clock.BlockUntil(1)
+	clock.Advance(MacaroonLifetime + 10*time.Second)
+	clock.BlockUntil(1)
+
+	if _, err := auth.ExtractToken(freshToken); err != ErrNonceUsed {
+		t.Fatalf("replayed token should be rejected: %v", err)
+	}
 }
@@ -0,0 +1,478 @@
+// Package boltdb implements the persistent auth.DB on top of the bbolt
+// key-value storage. Unlike the in-memory database it keeps used nonces
+// across the service restarts, which makes it safe to use macaroon lifetime
+// greater than possible service downtime.
+package boltdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// rootKeysBucket stores root keys by their big-endian id.
+	rootKeysBucket = []byte("root-keys")
+
+	// noncesBucket stores nested bucket for every principal, where nonces
+	// are mapped on the time until which they are kept.
+	noncesBucket = []byte("nonces")
+
+	// nonceStatesBucket stores replay protection state by principal.
+	nonceStatesBucket = []byte("nonce-states")
+
+	// spendingsBucket stores the amount spent within the quota period by
+	// the spending key, value is the big-endian expiration time followed by
+	// the big-endian amount.
+	spendingsBucket = []byte("spendings")
+
+	// revokedTokensBucket stores the ids of revoked tokens.
+	revokedTokensBucket = []byte("revoked-tokens")
+
+	// revokedUsersBucket stores user revocation time by user id.
+	revokedUsersBucket = []byte("revoked-users")
+
+	// applicationsBucket stores applications by their big-endian id.
+	applicationsBucket = []byte("applications")
+)
+
+// DB is the persistent implementation of auth.DB.
+type DB struct {
+	db            *bbolt.DB
+	nonceLifetime time.Duration
+	clock         auth.Clock
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// Runtime check to ensure that DB implements auth.DB.
+var _ auth.DB = (*DB)(nil)
+
+// Open opens or creates the database file by the given path. Nonces are
+// kept in the database at least for the nonce lifetime, and until the
+// request expiration if it is later. Nonce lifetime is also the period of
+// background compaction, which is timed by the given clock.
+func Open(path string, nonceLifetime time.Duration,
+	clock auth.Clock) (*DB, error) {
+
+	bdb, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = bdb.Update(func(tx *bbolt.Tx) error {
+		buckets := [][]byte{
+			rootKeysBucket,
+			noncesBucket,
+			nonceStatesBucket,
+			spendingsBucket,
+			revokedTokensBucket,
+			revokedUsersBucket,
+			applicationsBucket,
+		}
+
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	return &DB{
+		db:            bdb,
+		nonceLifetime: nonceLifetime,
+		clock:         clock,
+		quit:          make(chan struct{}),
+	}, nil
+}
+
+// Close closes the underlying database file.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// StartFlushing starts background compaction which periodically removes
+// expired nonces and spendings from the database.
+func (db *DB) StartFlushing() {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+
+		for {
+			select {
+			case <-db.clock.After(db.nonceLifetime):
+			case <-db.quit:
+				return
+			}
+
+			// Error is ignored because the next iteration will try
+			// to remove the same records again.
+			db.FlushNonces()
+			db.FlushSpendings()
+		}
+	}()
+}
+
+// StopFlushing stops background compaction of nonces.
+func (db *DB) StopFlushing() {
+	close(db.quit)
+	db.wg.Wait()
+}
+
+// FlushNonces removes nonces which are kept longer than required.
+func (db *DB) FlushNonces() error {
+	now := db.clock.Now()
+
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		nonces := tx.Bucket(noncesBucket)
+
+		var emptyPrincipals [][]byte
+		err := nonces.ForEach(func(principal, _ []byte) error {
+			principalNonces := nonces.Bucket(principal)
+
+			var expired [][]byte
+			err := principalNonces.ForEach(func(nonce, keepUntil []byte) error {
+				if decodeTime(keepUntil).Before(now) {
+					expired = append(expired, nonce)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, nonce := range expired {
+				if err := principalNonces.Delete(nonce); err != nil {
+					return err
+				}
+			}
+
+			if key, _ := principalNonces.Cursor().First(); key == nil {
+				emptyPrincipals = append(emptyPrincipals, principal)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, principal := range emptyPrincipals {
+			if err := nonces.DeleteBucket(principal); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FlushSpendings removes spendings which quota period has ended.
+func (db *DB) FlushSpendings() error {
+	now := db.clock.Now()
+
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		spendings := tx.Bucket(spendingsBucket)
+
+		var expired [][]byte
+		err := spendings.ForEach(func(key, data []byte) error {
+			if decodeTime(data[:8]).Before(now) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := spendings.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) UseNonce(principal string, nonce int64,
+	expiresAt time.Time) (bool, error) {
+
+	var used bool
+	err := db.db.Update(func(tx *bbolt.Tx) error {
+		principalNonces, err := tx.Bucket(noncesBucket).
+			CreateBucketIfNotExists([]byte(principal))
+		if err != nil {
+			return err
+		}
+
+		key := encodeUint64(uint64(nonce))
+		if principalNonces.Get(key) != nil {
+			used = true
+			return nil
+		}
+
+		// Nonce is kept at least for the nonce lifetime, and longer if
+		// request remains fresh after it.
+		keepUntil := db.clock.Now().Add(db.nonceLifetime)
+		if expiresAt.After(keepUntil) {
+			keepUntil = expiresAt
+		}
+
+		return principalNonces.Put(key, encodeTime(keepUntil))
+	})
+
+	return used, err
+}
+
+func (db *DB) UpdateNonceState(principal string,
+	update func(state []byte) ([]byte, error)) error {
+
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		states := tx.Bucket(nonceStatesBucket)
+
+		// Value returned by bolt is valid only within transaction, so we
+		// copy it before passing to the update function.
+		var state []byte
+		if data := states.Get([]byte(principal)); data != nil {
+			state = append([]byte(nil), data...)
+		}
+
+		newState, err := update(state)
+		if err != nil {
+			return err
+		}
+
+		return states.Put([]byte(principal), newState)
+	})
+}
+
+func (db *DB) UpdateSpending(key string, expiresAt time.Time,
+	update func(spent uint64) (uint64, error)) error {
+
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		spendings := tx.Bucket(spendingsBucket)
+
+		var spent uint64
+		if data := spendings.Get([]byte(key)); data != nil {
+			spent = binary.BigEndian.Uint64(data[8:])
+		}
+
+		newSpent, err := update(spent)
+		if err != nil {
+			return err
+		}
+
+		data := append(encodeTime(expiresAt), encodeUint64(newSpent)...)
+		return spendings.Put([]byte(key), data)
+	})
+}
+
+func (db *DB) GetRootKey() (*auth.RootKey, error) {
+	var key *auth.RootKey
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		_, data := tx.Bucket(rootKeysBucket).Cursor().Last()
+		if data == nil {
+			return auth.ErrRootKeyNotFound
+		}
+
+		key = &auth.RootKey{}
+		return json.Unmarshal(data, key)
+	})
+
+	return key, err
+}
+
+func (db *DB) GetRootKeyByID(id uint32) (*auth.RootKey, error) {
+	var key *auth.RootKey
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(rootKeysBucket).Get(encodeUint32(id))
+		if data == nil {
+			return auth.ErrRootKeyNotFound
+		}
+
+		key = &auth.RootKey{}
+		return json.Unmarshal(data, key)
+	})
+
+	return key, err
+}
+
+func (db *DB) PutRootKey(rootKey []byte) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		keys := tx.Bucket(rootKeysBucket)
+		now := db.clock.Now()
+
+		// First key gets id 0, which makes tokens issued in legacy format
+		// verifiable, every next key gets id of previous plus one.
+		var id uint32
+		lastID, data := keys.Cursor().Last()
+		if data != nil {
+			lastKey := &auth.RootKey{}
+			if err := json.Unmarshal(data, lastKey); err != nil {
+				return err
+			}
+
+			lastKey.RetiredAt = now
+			if err := putJSON(keys, lastID, lastKey); err != nil {
+				return err
+			}
+
+			id = lastKey.ID + 1
+		}
+
+		return putJSON(keys, encodeUint32(id), &auth.RootKey{
+			ID:        id,
+			Key:       rootKey,
+			CreatedAt: now,
+		})
+	})
+}
+
+func (db *DB) RevokeToken(tokenID string) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(revokedTokensBucket).Put([]byte(tokenID), []byte{})
+	})
+}
+
+func (db *DB) IsTokenRevoked(tokenID string) (bool, error) {
+	var revoked bool
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		revoked = tx.Bucket(revokedTokensBucket).Get([]byte(tokenID)) != nil
+		return nil
+	})
+
+	return revoked, err
+}
+
+func (db *DB) RevokeUserTokens(userID auth.UserID, before time.Time) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(revokedUsersBucket)
+		key := []byte(userID)
+
+		// Revocation time could only be moved forward, otherwise already
+		// revoked tokens would become valid again.
+		if data := users.Get(key); data != nil {
+			if !before.After(decodeTime(data)) {
+				return nil
+			}
+		}
+
+		return users.Put(key, encodeTime(before))
+	})
+}
+
+func (db *DB) GetUserRevocationTime(userID auth.UserID) (time.Time, error) {
+	var t time.Time
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(revokedUsersBucket).Get([]byte(userID))
+		if data != nil {
+			t = decodeTime(data)
+		}
+		return nil
+	})
+
+	return t, err
+}
+
+func (db *DB) PutApplication(app *auth.Application) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		apps := tx.Bucket(applicationsBucket)
+
+		// Sequence starts from one, zero id is reserved for tokens which
+		// are not bound to the application.
+		id, err := apps.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		storedApp := *app
+		storedApp.ID = uint32(id)
+		if err := putJSON(apps, encodeUint32(storedApp.ID),
+			&storedApp); err != nil {
+			return err
+		}
+
+		app.ID = storedApp.ID
+		return nil
+	})
+}
+
+func (db *DB) GetApplication(id uint32) (*auth.Application, error) {
+	var app *auth.Application
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(applicationsBucket).Get(encodeUint32(id))
+		if data == nil {
+			return auth.ErrApplicationNotFound
+		}
+
+		app = &auth.Application{}
+		return json.Unmarshal(data, app)
+	})
+
+	return app, err
+}
+
+func (db *DB) GetUserApplications(userID auth.UserID) ([]*auth.Application,
+	error) {
+
+	var apps []*auth.Application
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(applicationsBucket).ForEach(func(_, data []byte) error {
+			app := &auth.Application{}
+			if err := json.Unmarshal(data, app); err != nil {
+				return err
+			}
+
+			if app.UserID == userID {
+				apps = append(apps, app)
+			}
+
+			return nil
+		})
+	})
+
+	return apps, err
+}
+
+func putJSON(bucket *bbolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, data)
+}
+
+func encodeUint32(v uint32) []byte {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], v)
+	return data[:]
+}
+
+func encodeUint64(v uint64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	return data[:]
+}
+
+func encodeTime(t time.Time) []byte {
+	return encodeUint64(uint64(t.UnixNano()))
+}
+
+func decodeTime(data []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+}
@@ -0,0 +1,115 @@
+package boltdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/bitlum/macaroon-application-auth/internal/dbtest"
+)
+
+// openTestDB opens database in the temporary directory, returned cleanup
+// function closes database and removes the directory.
+func openTestDB(t *testing.T, nonceLifetime time.Duration,
+	clock auth.Clock) (*DB, string, func()) {
+
+	dir, err := ioutil.TempDir("", "boltdb")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+
+	path := filepath.Join(dir, "auth.db")
+	db, err := Open(path, nonceLifetime, clock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to open db: %v", err)
+	}
+
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	return db, path, cleanup
+}
+
+func TestDB(t *testing.T) {
+	dbtest.TestDB(t, func(t *testing.T) (auth.DB, func()) {
+		db, _, cleanup := openTestDB(t, auth.MacaroonLifetime,
+			auth.SystemClock)
+		return db, cleanup
+	})
+}
+
+func TestNoncePersistence(t *testing.T) {
+	db, path, cleanup := openTestDB(t, auth.MacaroonLifetime,
+		auth.SystemClock)
+	defer cleanup()
+
+	if used, err := db.UseNonce("app_1", 10, time.Now()); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	// Emulate the service restart, used nonce should remain in the
+	// database.
+	if err := db.Close(); err != nil {
+		t.Fatalf("unable to close db: %v", err)
+	}
+
+	db, err := Open(path, auth.MacaroonLifetime, auth.SystemClock)
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	defer db.Close()
+
+	if used, err := db.UseNonce("app_1", 10, time.Now()); err != nil || !used {
+		t.Fatalf("nonce should be used: %v", err)
+	}
+}
+
+func TestNonceFlush(t *testing.T) {
+	const nonceLifetime = time.Minute
+
+	clock := auth.NewFakeClock(time.Now())
+	db, _, cleanup := openTestDB(t, nonceLifetime, clock)
+	defer cleanup()
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	// Nonce isn't expired yet and should remain.
+	if err := db.FlushNonces(); err != nil {
+		t.Fatalf("unable to flush nonces: %v", err)
+	}
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || !used {
+		t.Fatalf("nonce should be used: %v", err)
+	}
+
+	// Nonce of the request which remains fresh longer than nonce lifetime
+	// should be kept until request expiration.
+	expiresAt := clock.Now().Add(time.Hour)
+	if used, err := db.UseNonce("app_1", 11, expiresAt); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	// Wait for the compaction to be scheduled, and then for the next one to
+	// be scheduled after the flush has been done.
+	db.StartFlushing()
+	clock.BlockUntil(1)
+	clock.Advance(2 * nonceLifetime)
+	clock.BlockUntil(1)
+	db.StopFlushing()
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || used {
+		t.Fatalf("nonce should be flushed: %v", err)
+	}
+
+	if used, err := db.UseNonce("app_1", 11, expiresAt); err != nil || !used {
+		t.Fatalf("nonce should be kept: %v", err)
+	}
+}
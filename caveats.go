@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon.v2"
+)
+
+// caveatCheckFunc checks that the value of the caveat is well-formed. Caveat
+// semantic, such as expiration or permitted operations, is checked
+// separately when token is extracted or authorized.
+type caveatCheckFunc func(value string) error
+
+// knownCaveats is the registry of caveats which are interpreted by the auth.
+// Token which contains the caveat not from this registry is rejected,
+// because such caveat might be the restriction which we don't know how to
+// enforce, and ignoring it would make token over-privileged.
+var knownCaveats = map[string]caveatCheckFunc{
+	UserPrefix:              checkUserCaveat,
+	NoncePrefix:             checkIntCaveat,
+	TimePrefix:              checkIntCaveat,
+	DisabledOperationPrefix: checkOperationsCaveat,
+	AllowedOperationPrefix:  checkOperationsCaveat,
+	ExpiresPrefix:           checkIntCaveat,
+	NotBeforePrefix:         checkIntCaveat,
+	LifetimePrefix:          checkIntCaveat,
+	AllowedResourcePrefix:   checkOperationsCaveat,
+	AmountLimitPrefix:       checkLimitCaveat,
+	DailyQuotaPrefix:        checkLimitCaveat,
+	AllowedAddressPrefix:    checkAddressesCaveat,
+	RequestPrefix:           checkRequestCaveat,
+}
+
+// CaveatChecker checks the caveat of the application-specific restriction,
+// e.g. the account which token is permitted to access.
+type CaveatChecker interface {
+	// Condition returns the key of the caveat which is checked.
+	Condition() string
+
+	// Check checks that request described by the context satisfies the
+	// caveat value, error is returned if request is not permitted. Checker
+	// is called once the token is extracted and once again on every
+	// authorization, in the latter case context contains the operation and
+	// might contain the resource.
+	Check(ctx context.Context, value string) error
+}
+
+// caveatChecker is the CaveatChecker which is defined by the function.
+type caveatChecker struct {
+	condition string
+	check     func(ctx context.Context, value string) error
+}
+
+// NewCaveatChecker creates the checker of the caveat with the given key.
+func NewCaveatChecker(condition string,
+	check func(ctx context.Context, value string) error) CaveatChecker {
+
+	return &caveatChecker{
+		condition: condition,
+		check:     check,
+	}
+}
+
+// Condition returns the key of the caveat which is checked.
+//
+// NOTE: Part of the CaveatChecker interface.
+func (c *caveatChecker) Condition() string {
+	return c.condition
+}
+
+// Check checks that request satisfies the caveat value.
+//
+// NOTE: Part of the CaveatChecker interface.
+func (c *caveatChecker) Check(ctx context.Context, value string) error {
+	return c.check(ctx, value)
+}
+
+type operationKey struct{}
+
+// ContextWithOperation returns the context which contains the operation,
+// which is being authorized.
+func ContextWithOperation(ctx context.Context, op string) context.Context {
+	return context.WithValue(ctx, operationKey{}, op)
+}
+
+// OperationFromContext returns the operation which is being authorized, false
+// is returned if token is being extracted and operation is not known yet.
+func OperationFromContext(ctx context.Context) (string, bool) {
+	op, ok := ctx.Value(operationKey{}).(string)
+	return op, ok
+}
+
+type resourceKey struct{}
+
+// ResourceFromContext returns the resource which is being authorized, false
+// is returned if resource is not known.
+func ResourceFromContext(ctx context.Context) (string, bool) {
+	resource, ok := ctx.Value(resourceKey{}).(string)
+	return resource, ok
+}
+
+// tokenCaveat is the caveat of the token which is checked by the registered
+// checker.
+type tokenCaveat struct {
+	checker CaveatChecker
+	value   string
+}
+
+// registeredCaveats returns caveats of the macaroon which have registered
+// checkers, in the order they have been added.
+func (a *Auth) registeredCaveats(caveats []macaroon.Caveat) ([]tokenCaveat,
+	error) {
+
+	var result []tokenCaveat
+	for _, c := range caveats {
+		if isThirdPartyCaveat(c) {
+			continue
+		}
+
+		key, value, err := checkers.ParseCaveat(string(c.Id))
+		if err != nil {
+			return nil, err
+		}
+
+		if checker, ok := a.caveatCheckers[key]; ok {
+			result = append(result, tokenCaveat{
+				checker: checker,
+				value:   value,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// checkRegisteredCaveats runs the registered checkers for every caveat.
+func checkRegisteredCaveats(ctx context.Context, caveats []tokenCaveat) error {
+	for _, c := range caveats {
+		if err := c.checker.Check(ctx, c.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkCaveat checks that caveat is known and well-formed, it is used as the
+// first-party caveat checker during macaroon signature verification.
+func (a *Auth) checkCaveat(caveat string) error {
+	key, value, err := checkers.ParseCaveat(caveat)
+	if err != nil {
+		return err
+	}
+
+	// Semantic of application-specific caveats is checked by the registered
+	// checker after the signature verification.
+	if _, ok := a.caveatCheckers[key]; ok {
+		return nil
+	}
+
+	check, ok := knownCaveats[key]
+	if !ok {
+		if a.allowUnknownCaveats {
+			return nil
+		}
+
+		return ErrUnknownCaveat
+	}
+
+	return check(value)
+}
+
+func checkUserCaveat(value string) error {
+	if value == "" {
+		return errors.Errorf("user id is empty")
+	}
+
+	return nil
+}
+
+func checkIntCaveat(value string) error {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err
+}
+
+func checkOperationsCaveat(value string) error {
+	return validateOperations(splitOperations(value))
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-errors/errors"
+
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+)
+
+// addCaveat emulates the client which adds arbitrary caveat to the token.
+func addCaveat(t *testing.T, tokenStr, key, value string) string {
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	caveat := checkers.Condition(key, value)
+	if err := m.AddFirstPartyCaveat([]byte(caveat)); err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+
+	tokenStr, err = EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	return tokenStr
+}
+
+func TestUnknownCaveat(t *testing.T) {
+	db := NewInMemoryDB([]byte("kek"), MacaroonLifetime)
+	auth, err := NewAuth("", db)
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	tokenStr = addCaveat(t, tokenStr, "country", "ch")
+
+	_, err = auth.ExtractToken(addFreshness(t, tokenStr, 1))
+	if err != ErrUnknownCaveat {
+		t.Fatalf("token with unknown caveat should be rejected: %v", err)
+	}
+
+	// In compatibility mode unknown caveat should be ignored.
+	compatAuth, err := NewAuth("", db, AllowUnknownCaveats())
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	if _, err := compatAuth.ExtractToken(addFreshness(t, tokenStr,
+		2)); err != nil {
+		t.Fatalf("token should be accepted in compatibility mode: %v", err)
+	}
+}
+
+func TestMalformedCaveat(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		AllowUnknownCaveats())
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Known caveats should be well-formed even in compatibility mode.
+	tokenStr = addCaveat(t, tokenStr, DisabledOperationPrefix, "wallet.[")
+
+	if _, err := auth.ExtractToken(addFreshness(t, tokenStr, 1)); err == nil {
+		t.Fatalf("token with malformed caveat should be rejected")
+	}
+}
+
+type accountKey struct{}
+
+func TestCaveatCheckers(t *testing.T) {
+	// Token is permitted to access only the given account.
+	accountChecker := NewCaveatChecker("account",
+		func(ctx context.Context, value string) error {
+			if ctx.Value(accountKey{}) != value {
+				return errors.Errorf("account not allowed")
+			}
+			return nil
+		})
+
+	// Token is permitted to withdraw only the given amount, other
+	// operations are not restricted.
+	errAmountExceeded := errors.Errorf("amount exceeded")
+	amountChecker := NewCaveatChecker("max_amount",
+		func(ctx context.Context, value string) error {
+			op, ok := OperationFromContext(ctx)
+			if !ok || op != "withdraw" {
+				return nil
+			}
+
+			if value != "100" {
+				return errAmountExceeded
+			}
+			return nil
+		})
+
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		CaveatCheckers(accountChecker, amountChecker))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		ApplicationCaveat("account", "alice"),
+		ApplicationCaveat("max_amount", "200"))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), accountKey{}, "bob")
+	_, err = auth.ExtractTokenContext(ctx, addFreshness(t, tokenStr, 1))
+	if err == nil {
+		t.Fatalf("token of other account should be rejected")
+	}
+
+	ctx = context.WithValue(context.Background(), accountKey{}, "alice")
+	token, err := auth.ExtractTokenContext(ctx, addFreshness(t, tokenStr, 2))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if err := token.IsAuthorized("balance"); err != nil {
+		t.Fatalf("operation should be allowed: %v", err)
+	}
+
+	if err := token.IsAuthorized("withdraw"); err != errAmountExceeded {
+		t.Fatalf("operation should be not allowed: %v", err)
+	}
+
+	// Caveat without registered checker couldn't be added to the token.
+	_, err = auth.GenerateToken("100", appID, nil, ApplicationCaveat("ip", "::1"))
+	if err != ErrUnknownCaveat {
+		t.Fatalf("unknown caveat should be rejected: %v", err)
+	}
+
+	// Checker couldn't override the caveat interpreted by the auth.
+	_, err = NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		CaveatCheckers(NewCaveatChecker(UserPrefix, nil)))
+	if err == nil {
+		t.Fatalf("reserved caveat checker should be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time, it is used instead of direct
+// calls to time package, so that expiration could be tested
+// deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the clock which uses the system time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is the clock which time is changed only manually, it is used in
+// tests.
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+// fakeWaiter is the pending After call of the fake clock.
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// Runtime check to ensure that FakeClock implements Clock.
+var _ Clock = (*FakeClock)(nil)
+
+// NewFakeClock creates new fake clock which is set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{
+		now: now,
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Now returns the current time of the fake clock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// After returns the channel which receives the time when the fake clock is
+// advanced at least by the given duration.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	waiter := &fakeWaiter{
+		deadline: c.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		waiter.c <- c.now
+		return waiter.c
+	}
+
+	c.waiters = append(c.waiters, waiter)
+	c.cond.Broadcast()
+	return waiter.c
+}
+
+// Advance moves the time of the fake clock forward and notifies waiters
+// which deadline has come.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set sets the time of the fake clock and notifies waiters which deadline
+// has come.
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = now
+
+	var pending []*fakeWaiter
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(now) {
+			pending = append(pending, waiter)
+			continue
+		}
+
+		waiter.c <- now
+	}
+	c.waiters = pending
+}
+
+// BlockUntil blocks until the given number of goroutines are waiting on the
+// channels returned by After. It allows to advance the clock only after
+// background goroutine started waiting.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1540000000, 0)
+	clock := NewFakeClock(start)
+
+	if !clock.Now().Equal(start) {
+		t.Fatalf("wrong time: %v", clock.Now())
+	}
+
+	first := clock.After(time.Second)
+	second := clock.After(2 * time.Second)
+	clock.BlockUntil(2)
+
+	clock.Advance(time.Second)
+
+	select {
+	case now := <-first:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("wrong time: %v", now)
+		}
+	default:
+		t.Fatalf("first waiter should be notified")
+	}
+
+	select {
+	case <-second:
+		t.Fatalf("second waiter shouldn't be notified")
+	default:
+	}
+
+	clock.Set(start.Add(time.Hour))
+
+	select {
+	case <-second:
+	default:
+		t.Fatalf("second waiter should be notified")
+	}
+
+	select {
+	case <-clock.After(0):
+	default:
+		t.Fatalf("waiter with zero duration should be notified")
+	}
+}
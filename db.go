@@ -6,42 +6,156 @@ import (
 	"fmt"
 )
 
+// RootKey is the secret which is used to sign the macaroons. Every key has
+// an id which is embedded in the macaroon id, so that after key rotation
+// tokens signed with the previous key could still be verified.
+type RootKey struct {
+	// ID is the identifier of the key, ids are assigned by the database
+	// in increasing order.
+	ID uint32
+
+	// Key is the secret itself.
+	Key []byte
+
+	// CreatedAt is the time when key has been put in the database.
+	CreatedAt time.Time
+
+	// RetiredAt is the time when key has been replaced with the newer one,
+	// zero time means that key is the current one.
+	RetiredAt time.Time
+}
+
+// IsRetired returns true if key has been replaced with the newer one.
+func (k *RootKey) IsRetired() bool {
+	return !k.RetiredAt.IsZero()
+}
+
 // DB represent the storage for macaroon application authentication which is
 // needed to keep it secure.
 type DB interface {
-	// UseNonce mark the nonce as used by the given user.
-	UseNonce(id uint32, nonce int64) bool
+	// UseNonce mark the nonce as used within the given principal, which is
+	// either application, child token, or user for legacy tokens. Returns
+	// true if nonce has been already used. Nonce should be kept at least
+	// until the given expiration time of the request, otherwise request
+	// could be replayed while it is still fresh.
+	UseNonce(principal string, nonce int64, expiresAt time.Time) (bool,
+		error)
 
-	// GetRootKey returns last stored root key.
-	GetRootKey() ([]byte, error)
+	// UpdateNonceState atomically replaces the replay protection state of
+	// the principal with the one returned by update function, which
+	// receives the current state or nil if principal doesn't have it yet.
+	// If update function returns an error state is left unchanged and error
+	// is returned. Update function might be called several times if
+	// database uses optimistic locking.
+	UpdateNonceState(principal string,
+		update func(state []byte) ([]byte, error)) error
 
-	// PutRootKey puts new root key. This method might be used for db
+	// UpdateSpending atomically replaces the amount spent within the given
+	// key with the one returned by update function, which receives the
+	// current amount or zero if nothing has been spent yet. If update
+	// function returns an error amount is left unchanged and error is
+	// returned. Record might be removed after the given expiration time.
+	UpdateSpending(key string, expiresAt time.Time,
+		update func(spent uint64) (uint64, error)) error
+
+	// GetRootKey returns last stored root key, which is used to sign new
+	// tokens.
+	GetRootKey() (*RootKey, error)
+
+	// GetRootKeyByID returns either the current or one of the retired root
+	// keys. If key not found ErrRootKeyNotFound is returned.
+	GetRootKeyByID(id uint32) (*RootKey, error)
+
+	// PutRootKey puts new root key, which becomes the current one, previous
+	// key is marked as retired. This method might be used for db
 	// initialisation or key rotation.
 	PutRootKey(rootKey []byte) error
+
+	// RevokeToken marks the token with the given id as revoked.
+	RevokeToken(tokenID string) error
+
+	// IsTokenRevoked returns true if token with the given id has been
+	// revoked.
+	IsTokenRevoked(tokenID string) (bool, error)
+
+	// RevokeUserTokens revokes all tokens of the user which have been issued
+	// before the given time.
+	RevokeUserTokens(userID UserID, before time.Time) error
+
+	// GetUserRevocationTime returns the time before which all tokens of the
+	// user are considered revoked, zero time is returned if user tokens
+	// haven't been revoked.
+	GetUserRevocationTime(userID UserID) (time.Time, error)
+
+	// PutApplication stores new application and assigns the unique non-zero
+	// id to it.
+	PutApplication(app *Application) error
+
+	// GetApplication returns the application by its id. If application not
+	// found ErrApplicationNotFound is returned.
+	GetApplication(id uint32) (*Application, error)
+
+	// GetUserApplications returns all applications of the user.
+	GetUserApplications(userID UserID) ([]*Application, error)
+}
+
+// spending is the amount spent within the quota period.
+type spending struct {
+	amount    uint64
+	expiresAt time.Time
 }
 
 // InMemoryDB represent the in-memory storage for nonce and keeps root key
 // also in memory, such schema allows requests to proceed fast.
 //
 // NOTE: If macaroon lifetime becomes bigger enough such schema might become
-// insecure.
+// insecure, in this case persistent database, such as boltdb.DB, should be
+// used.
 type InMemoryDB struct {
-	nonces        map[string]time.Time
-	rootKey       []byte
+	nonces        map[string]time.Time // nonce -> time until it is kept
+	nonceStates   map[string][]byte
+	spendings     map[string]*spending
+	rootKeys      []*RootKey
 	nonceLifetime time.Duration
+	clock         Clock
+
+	revokedTokens map[string]struct{}
+	revokedUsers  map[UserID]time.Time
+
+	applications []*Application
 
 	mutex sync.Mutex
 	wg    sync.WaitGroup
 	quit  chan struct{}
 }
 
+// NewInMemoryDB creates new in-memory database, given root key is stored
+// with id 0, which makes tokens issued in legacy format verifiable.
 func NewInMemoryDB(rootKey []byte, nonceLifetime time.Duration) *InMemoryDB {
-	return &InMemoryDB{
+	return NewInMemoryDBWithClock(rootKey, nonceLifetime, SystemClock)
+}
+
+// NewInMemoryDBWithClock creates new in-memory database which uses the given
+// clock to track nonce expiration.
+func NewInMemoryDBWithClock(rootKey []byte, nonceLifetime time.Duration,
+	clock Clock) *InMemoryDB {
+
+	db := &InMemoryDB{
 		nonces:        make(map[string]time.Time),
-		rootKey:       rootKey,
+		nonceStates:   make(map[string][]byte),
+		spendings:     make(map[string]*spending),
+		revokedTokens: make(map[string]struct{}),
+		revokedUsers:  make(map[UserID]time.Time),
 		quit:          make(chan struct{}),
 		nonceLifetime: nonceLifetime,
+		clock:         clock,
 	}
+
+	if rootKey != nil {
+		db.PutRootKey(rootKey)
+	}
+
+	return db
 }
 
 func (db *InMemoryDB) StartFlushing() {
@@ -51,7 +165,7 @@ func (db *InMemoryDB) StartFlushing() {
 
 		for {
 			select {
-			case <-time.After(db.nonceLifetime):
+			case <-db.clock.After(db.nonceLifetime):
 			case <-db.quit:
 				return
 			}
@@ -59,11 +173,17 @@ func (db *InMemoryDB) StartFlushing() {
 			db.mutex.Lock()
 
 			for key, t := range db.nonces {
-				if t.Add(db.nonceLifetime).Before(time.Now()) {
+				if t.Before(db.clock.Now()) {
 					delete(db.nonces, key)
 				}
 			}
 
+			for key, s := range db.spendings {
+				if s.expiresAt.Before(db.clock.Now()) {
+					delete(db.spendings, key)
+				}
+			}
+
 			db.mutex.Unlock()
 		}
 	}()
@@ -77,38 +197,187 @@ func (db *InMemoryDB) StopFlushing() {
 // Runtime check to ensure that InMemoryDB implements DB.
 var _ DB = (*InMemoryDB)(nil)
 
-func (db *InMemoryDB) UseNonce(id uint32, nonce int64) bool {
+func (db *InMemoryDB) UseNonce(principal string, nonce int64,
+	expiresAt time.Time) (bool, error) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// If service has been shutdown and started faster than macaroon
+	// lifetime attacker would have a period of time where he could reuse
+	// the stolen macaroon, because in this case db don't have the nonce.
+	key := getKey(principal, nonce)
+	if _, ok := db.nonces[key]; ok {
+		return true, nil
+	}
+
+	// Nonce is kept at least for the nonce lifetime, and longer if request
+	// remains fresh after it.
+	keepUntil := db.clock.Now().Add(db.nonceLifetime)
+	if expiresAt.After(keepUntil) {
+		keepUntil = expiresAt
+	}
+
+	db.nonces[key] = keepUntil
+	return false, nil
+}
+
+func (db *InMemoryDB) UpdateNonceState(principal string,
+	update func(state []byte) ([]byte, error)) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	state, err := update(db.nonceStates[principal])
+	if err != nil {
+		return err
+	}
+
+	db.nonceStates[principal] = state
+	return nil
+}
+
+func (db *InMemoryDB) UpdateSpending(key string, expiresAt time.Time,
+	update func(spent uint64) (uint64, error)) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var spent uint64
+	if s, ok := db.spendings[key]; ok {
+		spent = s.amount
+	}
+
+	newSpent, err := update(spent)
+	if err != nil {
+		return err
+	}
+
+	db.spendings[key] = &spending{
+		amount:    newSpent,
+		expiresAt: expiresAt,
+	}
+	return nil
+}
+
+func (db *InMemoryDB) GetRootKey() (*RootKey, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	key := getKey(id, nonce)
-	if _, ok := db.nonces[key]; !ok {
-		// If service has been shutdown and started faster than macaroon
-		// lifetime attacker would have a period of time where he could reuse
-		// the stolen macaroon, because in this case db don't have nonce for id
-		// and returns zero.
-		return false
+	if len(db.rootKeys) == 0 {
+		return nil, ErrRootKeyNotFound
 	}
 
-	db.nonces[key] = time.Now()
-	return true
+	key := *db.rootKeys[len(db.rootKeys)-1]
+	return &key, nil
 }
 
-func (db *InMemoryDB) GetRootKey() ([]byte, error) {
+func (db *InMemoryDB) GetRootKeyByID(id uint32) (*RootKey, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	return db.rootKey, nil
+	if uint64(id) >= uint64(len(db.rootKeys)) {
+		return nil, ErrRootKeyNotFound
+	}
+
+	key := *db.rootKeys[id]
+	return &key, nil
 }
 
 func (db *InMemoryDB) PutRootKey(rootKey []byte) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	db.rootKey = rootKey
+	now := db.clock.Now()
+	if len(db.rootKeys) != 0 {
+		db.rootKeys[len(db.rootKeys)-1].RetiredAt = now
+	}
+
+	db.rootKeys = append(db.rootKeys, &RootKey{
+		ID:        uint32(len(db.rootKeys)),
+		Key:       rootKey,
+		CreatedAt: now,
+	})
+
+	return nil
+}
+
+func (db *InMemoryDB) RevokeToken(tokenID string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.revokedTokens[tokenID] = struct{}{}
+	return nil
+}
+
+func (db *InMemoryDB) IsTokenRevoked(tokenID string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, ok := db.revokedTokens[tokenID]
+	return ok, nil
+}
+
+func (db *InMemoryDB) RevokeUserTokens(userID UserID, before time.Time) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// Revocation time could only be moved forward, otherwise already revoked
+	// tokens would become valid again.
+	if before.After(db.revokedUsers[userID]) {
+		db.revokedUsers[userID] = before
+	}
+
+	return nil
+}
+
+func (db *InMemoryDB) GetUserRevocationTime(userID UserID) (time.Time, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.revokedUsers[userID], nil
+}
+
+func (db *InMemoryDB) PutApplication(app *Application) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// Zero id is reserved for tokens which are not bound to the application.
+	app.ID = uint32(len(db.applications)) + 1
+
+	storedApp := *app
+	db.applications = append(db.applications, &storedApp)
 	return nil
 }
 
-func getKey(id uint32, nonce int64) string {
-	return fmt.Sprintf("%v_%v", id, nonce)
+func (db *InMemoryDB) GetApplication(id uint32) (*Application, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if id == 0 || uint64(id) > uint64(len(db.applications)) {
+		return nil, ErrApplicationNotFound
+	}
+
+	app := *db.applications[id-1]
+	return &app, nil
+}
+
+func (db *InMemoryDB) GetUserApplications(userID UserID) ([]*Application,
+	error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var apps []*Application
+	for _, app := range db.applications {
+		if app.UserID == userID {
+			userApp := *app
+			apps = append(apps, &userApp)
+		}
+	}
+
+	return apps, nil
+}
+
+func getKey(principal string, nonce int64) string {
+	return fmt.Sprintf("%v_%v", principal, nonce)
 }
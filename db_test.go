@@ -0,0 +1,14 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/bitlum/macaroon-application-auth/internal/dbtest"
+)
+
+func TestInMemoryDB(t *testing.T) {
+	dbtest.TestDB(t, func(t *testing.T) (auth.DB, func()) {
+		return auth.NewInMemoryDB(nil, auth.MacaroonLifetime), func() {}
+	})
+}
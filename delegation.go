@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon.v2"
+)
+
+// IssueTokenOperation is the operation which token should be permitted to
+// make in order to issue child tokens.
+const IssueTokenOperation = "issue_api_token"
+
+// nonInheritedCaveats are the caveats of the parent token which are not
+// copied to the child token, because they either identify the particular
+// request or are set for the child token separately.
+var nonInheritedCaveats = map[string]struct{}{
+	UserPrefix:     {},
+	NoncePrefix:    {},
+	TimePrefix:     {},
+	RequestPrefix:  {},
+	LifetimePrefix: {},
+}
+
+// IssueChildToken issues the token on behalf of the given parent token, which
+// should be permitted to make IssueTokenOperation, including by the
+// application caveat checkers. Child token inherits all restrictions of the
+// parent, and given disabled operations and options could only narrow them
+// further. Child token records the parent token id, and is revoked together
+// with any of its ancestors.
+func (a *Auth) IssueChildToken(parent *Token, disabledOperations []string,
+	opts ...TokenOption) (string, error) {
+
+	if !IsOperationAllowed(parent.macaroon, IssueTokenOperation) {
+		return "", ErrOperNotAllowed
+	}
+
+	// Application-specific caveats of the parent might restrict issuing of
+	// child tokens as well as any other operation.
+	ctx := ContextWithOperation(parent.ctx, IssueTokenOperation)
+	if err := checkRegisteredCaveats(ctx, parent.caveats); err != nil {
+		return "", err
+	}
+
+	// Legacy tokens couldn't be revoked by id, so revocation couldn't be
+	// cascaded to their children.
+	if parent.tokenID == nil || parent.applicationID == 0 {
+		return "", errors.Errorf("legacy token couldn't issue child tokens")
+	}
+
+	inherited, err := inheritedCaveats(parent.macaroon)
+	if err != nil {
+		return "", err
+	}
+
+	options := &tokenOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	// Request lifetime of the child couldn't be longer than the lifetime of
+	// the parent.
+	parentLifetime, err := requestLifetime(parent.macaroon, a.lifetime)
+	if err != nil {
+		return "", err
+	}
+
+	if options.lifetime == 0 || options.lifetime > parentLifetime {
+		options.lifetime = parentLifetime
+	}
+
+	// Quotas of the parent which are not inherited from its lineage have
+	// been introduced by the parent itself.
+	var parentQuotas uint32
+	for _, caveat := range inherited {
+		if caveat[0] == DailyQuotaPrefix {
+			parentQuotas++
+		}
+	}
+	for _, n := range parent.lineageQuotas {
+		parentQuotas -= n
+	}
+
+	lineage := append([][]byte{parent.tokenID}, parent.lineage...)
+	lineageQuotas := append([]uint32{parentQuotas}, parent.lineageQuotas...)
+	return a.issueToken(parent.applicationID, parent.userID, lineage,
+		lineageQuotas, inherited, disabledOperations, options)
+}
+
+// inheritedCaveats returns the restriction caveats of the parent token which
+// should be copied to the child token, in the order they have been added.
+func inheritedCaveats(m *macaroon.Macaroon) ([][2]string, error) {
+	var caveats [][2]string
+	for _, c := range m.Caveats() {
+		// Third-party caveat is bound to the signature of the parent, so it
+		// couldn't be copied.
+		if isThirdPartyCaveat(c) {
+			return nil, errors.Errorf("token with third-party caveats " +
+				"couldn't issue child tokens")
+		}
+
+		key, value, err := checkers.ParseCaveat(string(c.Id))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := nonInheritedCaveats[key]; ok {
+			continue
+		}
+
+		caveats = append(caveats, [2]string{key, value})
+	}
+
+	return caveats, nil
+}
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-errors/errors"
+)
+
+func TestIssueChildToken(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID, []string{"wallet.send"})
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	childStr, err := auth.IssueChildToken(parent, []string{"wallet.balance"})
+	if err != nil {
+		t.Fatalf("unable to issue child token: %v", err)
+	}
+
+	child, err := auth.ExtractToken(addFreshness(t, childStr, 2))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if child.ParentID() != parent.ID() {
+		t.Fatalf("wrong parent id: %v, expected %v", child.ParentID(),
+			parent.ID())
+	}
+
+	if parent.ParentID() != "" {
+		t.Fatalf("server token shouldn't have parent: %v", parent.ParentID())
+	}
+
+	if child.ApplicationID() != appID || child.UserID() != "100" {
+		t.Fatalf("wrong child owner: %v, %v", child.ApplicationID(),
+			child.UserID())
+	}
+
+	// Child inherits restrictions of the parent and adds its own.
+	steps := []struct {
+		operation string
+		err       error
+	}{
+		{"wallet.send", ErrOperNotAllowed},
+		{"wallet.balance", ErrOperNotAllowed},
+		{"wallet.receive", nil},
+	}
+
+	for _, step := range steps {
+		if err := child.IsAuthorized(step.operation); err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", step.operation,
+				err, step.err)
+		}
+	}
+
+	// Grandchild is revoked together with any of its ancestors.
+	grandchildStr, err := auth.IssueChildToken(child, nil)
+	if err != nil {
+		t.Fatalf("unable to issue child token: %v", err)
+	}
+
+	if err := auth.RevokeToken(parent.ID()); err != nil {
+		t.Fatalf("unable to revoke token: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, childStr, 3))
+	if err != ErrTokenRevoked {
+		t.Fatalf("child of revoked token should be rejected: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, grandchildStr, 4))
+	if err != ErrTokenRevoked {
+		t.Fatalf("grandchild of revoked token should be rejected: %v", err)
+	}
+}
+
+func TestIssueChildTokenNotPermitted(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID,
+		[]string{IssueTokenOperation})
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	_, err = auth.IssueChildToken(parent, nil)
+	if err != ErrOperNotAllowed {
+		t.Fatalf("wrong error: %v, expected %v", err, ErrOperNotAllowed)
+	}
+}
+
+func TestIssueChildTokenCaveatChecker(t *testing.T) {
+	// Token is permitted to make any operation except issuing child tokens.
+	errDelegationDisabled := errors.Errorf("delegation disabled")
+	delegationChecker := NewCaveatChecker("delegation",
+		func(ctx context.Context, value string) error {
+			op, _ := OperationFromContext(ctx)
+			if op == IssueTokenOperation && value == "disabled" {
+				return errDelegationDisabled
+			}
+			return nil
+		})
+
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		CaveatCheckers(delegationChecker))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID, nil,
+		ApplicationCaveat("delegation", "disabled"))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	_, err = auth.IssueChildToken(parent, nil)
+	if err != errDelegationDisabled {
+		t.Fatalf("wrong error: %v, expected %v", err, errDelegationDisabled)
+	}
+}
+
+func TestIssueChildTokenLifetime(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID, nil,
+		TokenRequestLifetime(MacaroonLifetime/2))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	// Child couldn't extend the request lifetime of the parent.
+	childStr, err := auth.IssueChildToken(parent, nil,
+		TokenRequestLifetime(MacaroonLifetime*2))
+	if err != nil {
+		t.Fatalf("unable to issue child token: %v", err)
+	}
+
+	child, err := DecodeMacaroon(childStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	lifetime, err := requestLifetime(child, MacaroonLifetime)
+	if err != nil {
+		t.Fatalf("unable to get request lifetime: %v", err)
+	}
+
+	if lifetime != MacaroonLifetime/2 {
+		t.Fatalf("wrong lifetime: %v, expected %v", lifetime,
+			MacaroonLifetime/2)
+	}
+}
+
+func TestChildTokenNonces(t *testing.T) {
+	modes := []ReplayMode{ExactNonceMatch, IncreasingNonce, SlidingWindowNonce}
+	for _, mode := range modes {
+		auth, err := NewAuth("", NewInMemoryDB([]byte("kek"),
+			MacaroonLifetime), NonceReplayMode(mode))
+		if err != nil {
+			t.Fatalf("unable to create auth: %v", err)
+		}
+
+		appID := registerApplication(t, auth, "100")
+		parentStr, err := auth.GenerateToken("100", appID, nil)
+		if err != nil {
+			t.Fatalf("unable to generate macaroon token: %v", err)
+		}
+
+		parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+		if err != nil {
+			t.Fatalf("(%v) token should be accepted: %v", mode, err)
+		}
+
+		// Delegates couldn't coordinate nonces with the parent and with
+		// each other, so that every child has its own nonce space.
+		var children []string
+		for i := 0; i < 2; i++ {
+			childStr, err := auth.IssueChildToken(parent, nil)
+			if err != nil {
+				t.Fatalf("unable to issue child token: %v", err)
+			}
+
+			childStr = addFreshness(t, childStr, 1)
+			if _, err := auth.ExtractToken(childStr); err != nil {
+				t.Fatalf("(%v) child token should be accepted: %v",
+					mode, err)
+			}
+
+			children = append(children, childStr)
+		}
+
+		for _, childStr := range children {
+			if _, err := auth.ExtractToken(childStr); err == nil {
+				t.Fatalf("(%v) replayed child token should be "+
+					"rejected", mode)
+			}
+		}
+	}
+}
+
+func TestChildTokenQuota(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID, nil,
+		DailyQuota("wallet.withdraw", 100))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	// Parent and all its descendants draw from the same quota.
+	tokens := []*Token{parent}
+	for i := 0; i < 3; i++ {
+		childStr, err := auth.IssueChildToken(tokens[i], nil)
+		if err != nil {
+			t.Fatalf("unable to issue child token: %v", err)
+		}
+
+		child, err := auth.ExtractToken(addFreshness(t, childStr,
+			int64(i+2)))
+		if err != nil {
+			t.Fatalf("unable to extract token: %v", err)
+		}
+
+		tokens = append(tokens, child)
+	}
+
+	steps := []struct {
+		token  *Token
+		amount uint64
+		err    error
+	}{
+		{tokens[0], 40, nil},
+		{tokens[1], 40, nil},
+		{tokens[2], 30, ErrQuotaExceeded},
+		{tokens[2], 20, nil},
+		{tokens[3], 1, ErrQuotaExceeded},
+		{tokens[0], 1, ErrQuotaExceeded},
+	}
+
+	for i, step := range steps {
+		err := step.token.CheckLimit("wallet.withdraw", step.amount)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+}
+
+func TestSiblingChildTokenQuotas(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	parentStr, err := auth.GenerateToken("100", appID, nil,
+		DailyQuota("wallet", 150))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	parent, err := auth.ExtractToken(addFreshness(t, parentStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	// Quotas granted to siblings separately are counted separately, while
+	// the inherited quota of the parent is still shared by them.
+	var children []*Token
+	for i := 0; i < 2; i++ {
+		childStr, err := auth.IssueChildToken(parent, nil,
+			DailyQuota("wallet", 100))
+		if err != nil {
+			t.Fatalf("unable to issue child token: %v", err)
+		}
+
+		child, err := auth.ExtractToken(addFreshness(t, childStr, 1))
+		if err != nil {
+			t.Fatalf("unable to extract token: %v", err)
+		}
+
+		children = append(children, child)
+	}
+
+	// Grandchild shares the quotas of the parent and of the first child.
+	grandchildStr, err := auth.IssueChildToken(children[0], nil)
+	if err != nil {
+		t.Fatalf("unable to issue child token: %v", err)
+	}
+
+	grandchild, err := auth.ExtractToken(addFreshness(t, grandchildStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	steps := []struct {
+		token  *Token
+		amount uint64
+		err    error
+	}{
+		{children[0], 90, nil},
+		{grandchild, 20, ErrQuotaExceeded},
+		{grandchild, 10, nil},
+		{children[1], 60, ErrQuotaExceeded},
+		{children[1], 50, nil},
+		{parent, 1, ErrQuotaExceeded},
+	}
+
+	for i, step := range steps {
+		err := step.token.CheckLimit("wallet", step.amount)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+}
@@ -7,8 +7,28 @@ var (
 	ErrFieldExist    = errors.Errorf("field already exist")
 	ErrRepeatedField = errors.Errorf("repeated conditions")
 
-	ErrMacaroonExpired = errors.Errorf("macaroon expired")
-	ErrNonceUsed       = errors.Errorf("nonce is used already")
+	ErrMacaroonExpired    = errors.Errorf("macaroon expired")
+	ErrMacaroonFromFuture = errors.Errorf("macaroon time is in the future")
+	ErrNonceUsed          = errors.Errorf("nonce is used already")
+	ErrRequestMismatch    = errors.Errorf("request doesn't match macaroon")
+	ErrNonceTooLow        = errors.Errorf("nonce is not greater than " +
+		"previous one")
 
-	ErrOperNotAllowed = errors.Errorf("operation not allowed")
+	ErrOperNotAllowed     = errors.Errorf("operation not allowed")
+	ErrResourceNotAllowed = errors.Errorf("resource not allowed")
+	ErrAddressNotAllowed  = errors.Errorf("address not allowed")
+	ErrUnknownCaveat      = errors.Errorf("unknown caveat")
+	ErrThirdPartyNotFound = errors.Errorf("third-party key not found")
+
+	ErrAmountLimitExceeded = errors.Errorf("amount exceeds the limit")
+	ErrQuotaExceeded       = errors.Errorf("daily quota exceeded")
+
+	ErrRootKeyNotFound = errors.Errorf("root key not found")
+	ErrRootKeyRetired  = errors.Errorf("root key has been retired")
+
+	ErrTokenRevoked     = errors.Errorf("token has been revoked")
+	ErrTokenExpired     = errors.Errorf("token expired")
+	ErrTokenNotYetValid = errors.Errorf("token is not valid yet")
+
+	ErrApplicationNotFound = errors.Errorf("application not found")
 )
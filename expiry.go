@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"strconv"
+	"time"
+
+	"gopkg.in/macaroon.v2"
+)
+
+// AddExpiration restricts the macaroon to be valid only before the given
+// time. Unlike the time caveat, which is added by the client on every
+// request, expiration limits the lifetime of the token itself. If macaroon
+// already has the expiration, the earliest one is applied.
+func AddExpiration(m *macaroon.Macaroon, t time.Time) (*macaroon.Macaroon,
+	error) {
+
+	return addTimeRestriction(m, ExpiresPrefix, t)
+}
+
+// AddNotBefore restricts the macaroon to be valid only after the given time.
+// If macaroon already has such restriction, the latest one is applied.
+func AddNotBefore(m *macaroon.Macaroon, t time.Time) (*macaroon.Macaroon,
+	error) {
+
+	return addTimeRestriction(m, NotBeforePrefix, t)
+}
+
+func addTimeRestriction(m *macaroon.Macaroon, key string,
+	t time.Time) (*macaroon.Macaroon, error) {
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(key, strconv.FormatInt(t.UnixNano(), 10))
+}
+
+// checkValidityPeriod checks that the given time is within the validity
+// period of the macaroon, macaroon without expiration and not before
+// restrictions is valid forever.
+func checkValidityPeriod(m *macaroon.Macaroon, now time.Time) error {
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		return err
+	}
+
+	expirations, err := parseTimeRestrictions(md, ExpiresPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, expiration := range expirations {
+		if !now.Before(expiration) {
+			return ErrTokenExpired
+		}
+	}
+
+	notBefore, err := parseTimeRestrictions(md, NotBeforePrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range notBefore {
+		if now.Before(t) {
+			return ErrTokenNotYetValid
+		}
+	}
+
+	return nil
+}
+
+// parseTimeRestrictions returns all values of the time restriction field.
+func parseTimeRestrictions(md *MacaroonDictionary, key string) ([]time.Time,
+	error) {
+
+	values, err := md.GetAll(key)
+	if err == ErrFieldNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	times := make([]time.Time, 0, len(values))
+	for _, value := range values {
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		times = append(times, time.Unix(0, t))
+	}
+
+	return times, nil
+}
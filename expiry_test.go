@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenExpiration(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	auth, err := NewAuth("", db, TimeSource(clock))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	notBefore := clock.Now().Add(time.Hour)
+	expiresAt := clock.Now().Add(2 * time.Hour)
+	tokenStr, err := auth.GenerateToken("100", appID, nil, NotBefore(notBefore),
+		ExpiresAt(expiresAt))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	extract := func(tokenStr string, nonce int64) error {
+		m, err := DecodeMacaroon(tokenStr)
+		if err != nil {
+			t.Fatalf("unable to decode macaroon: %v", err)
+		}
+
+		m, err = AddNonce(m, nonce)
+		if err != nil {
+			t.Fatalf("unable to add nonce: %v", err)
+		}
+
+		m, err = AddCurrentTimeFrom(m, clock)
+		if err != nil {
+			t.Fatalf("unable to add current time: %v", err)
+		}
+
+		freshToken, err := EncodeMacaroon(m)
+		if err != nil {
+			t.Fatalf("unable to encode macaroon: %v", err)
+		}
+
+		_, err = auth.ExtractToken(freshToken)
+		return err
+	}
+
+	if err := extract(tokenStr, 1); err != ErrTokenNotYetValid {
+		t.Fatalf("token should be not valid yet: %v", err)
+	}
+
+	clock.Set(notBefore)
+	if err := extract(tokenStr, 2); err != nil {
+		t.Fatalf("token should be valid: %v", err)
+	}
+
+	// Holder of the token is able to shorten its validity period but not to
+	// prolong it.
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	shortened, err := AddExpiration(m, notBefore.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unable to add expiration: %v", err)
+	}
+
+	prolonged, err := AddExpiration(m, expiresAt.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unable to add expiration: %v", err)
+	}
+
+	shortenedStr, _ := EncodeMacaroon(shortened)
+	prolongedStr, _ := EncodeMacaroon(prolonged)
+
+	clock.Set(notBefore.Add(time.Minute))
+	if err := extract(shortenedStr, 3); err != ErrTokenExpired {
+		t.Fatalf("shortened token should be expired: %v", err)
+	}
+
+	clock.Set(expiresAt.Add(-time.Nanosecond))
+	if err := extract(tokenStr, 4); err != nil {
+		t.Fatalf("token should be valid: %v", err)
+	}
+
+	clock.Set(expiresAt)
+	if err := extract(tokenStr, 5); err != ErrTokenExpired {
+		t.Fatalf("token should be expired: %v", err)
+	}
+
+	if err := extract(prolongedStr, 6); err != ErrTokenExpired {
+		t.Fatalf("prolonged token should be expired: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	// identifierVersion is the version of the macaroon identifier format
+	// which is written by GenerateToken.
+	identifierVersion byte = 1
+
+	// legacyIdentifierSize is the size of identifier issued before the
+	// versioning has been introduced, it consists only of the big-endian
+	// user id and is considered to be signed with the root key 0.
+	legacyIdentifierSize = 4
+
+	// tokenIDSize is the size of the unique token id.
+	tokenIDSize = 16
+)
+
+// Types of the identifier fields. Types are never reused, new information is
+// added as the new field type, which makes identifiers written by the older
+// versions of the library decodable by the newer ones. Unknown field is
+// rejected, because it might be the restriction which we don't know how to
+// enforce.
+const (
+	// idFieldKeyID is the big-endian uint32 id of the root key.
+	idFieldKeyID byte = 1
+
+	// idFieldUserID is the big-endian uint32 or uint64 numeric user id.
+	idFieldUserID byte = 2
+
+	// idFieldTokenID is the random token id of tokenIDSize bytes.
+	idFieldTokenID byte = 3
+
+	// idFieldIssuedAt is the big-endian uint64 issue time in unix nanos.
+	idFieldIssuedAt byte = 4
+
+	// idFieldAppID is the big-endian uint32 application id.
+	idFieldAppID byte = 5
+
+	// idFieldLineage is the concatenated ids of parent tokens.
+	idFieldLineage byte = 6
+
+	// idFieldUserName is the string user id.
+	idFieldUserName byte = 7
+
+	// idFieldLineageQuotas is the concatenated big-endian uint32 numbers of
+	// daily quotas introduced by the tokens of the lineage.
+	idFieldLineageQuotas byte = 8
+)
+
+// identifier is the decoded representation of the macaroon id. Macaroon id
+// is covered by the macaroon signature, that is why we treat the information
+// stored in it as something which couldn't be changed by the client.
+//
+// Identifier is encoded as the version byte followed by the list of fields,
+// every field is encoded as the type byte, uvarint length and value. Key id
+// and user id are always present, other fields are omitted if they are
+// empty. Legacy identifier has no version and consists only of the user id.
+type identifier struct {
+	// keyID is the id of root key which was used to sign the macaroon.
+	keyID uint32
+
+	// applicationID is the id of the application for which token was
+	// issued. Legacy tokens are not bound to the application and have zero
+	// application id.
+	applicationID uint32
+
+	// userID is the id of the user on whose behalf token was issued.
+	// Numeric user id is encoded as 4 or 8 bytes big-endian integer, so
+	// that tokens of numeric users are encoded the same way as before
+	// string ids have been introduced, other ids are encoded as string.
+	userID UserID
+
+	// tokenID is the unique id of the token, which is used for token
+	// revocation. Legacy tokens do not have it.
+	tokenID []byte
+
+	// issuedAt is the time when token has been generated. Legacy tokens
+	// do not have it.
+	issuedAt time.Time
+
+	// lineage is the list of ids of tokens from which token has been
+	// issued, starting from the direct parent. Tokens generated by the
+	// server itself do not have it.
+	lineage [][]byte
+
+	// lineageQuotas is the number of daily quotas introduced by every token
+	// of the lineage, in the same order. Token inherits quotas ordered from
+	// the root of the lineage, so that every quota could be attributed to
+	// the token which has introduced it.
+	lineageQuotas []uint32
+}
+
+// encode serialises identifier in the latest format.
+func (id *identifier) encode() []byte {
+	data := []byte{identifierVersion}
+	data = appendUint32Field(data, idFieldKeyID, id.keyID)
+
+	userID, numeric := id.userID.Uint64()
+	switch {
+	case numeric && userID <= math.MaxUint32:
+		data = appendUint32Field(data, idFieldUserID, uint32(userID))
+	case numeric:
+		data = appendUint64Field(data, idFieldUserID, userID)
+	default:
+		data = appendField(data, idFieldUserName, []byte(id.userID))
+	}
+
+	if id.applicationID != 0 {
+		data = appendUint32Field(data, idFieldAppID, id.applicationID)
+	}
+
+	if id.tokenID != nil {
+		data = appendField(data, idFieldTokenID, id.tokenID)
+	}
+
+	if !id.issuedAt.IsZero() {
+		data = appendUint64Field(data, idFieldIssuedAt,
+			uint64(id.issuedAt.UnixNano()))
+	}
+
+	if len(id.lineage) != 0 {
+		var lineage []byte
+		for _, tokenID := range id.lineage {
+			lineage = append(lineage, tokenID...)
+		}
+
+		data = appendField(data, idFieldLineage, lineage)
+
+		var quotas []byte
+		for _, n := range id.lineageQuotas {
+			var v [4]byte
+			binary.BigEndian.PutUint32(v[:], n)
+			quotas = append(quotas, v[:]...)
+		}
+
+		data = appendField(data, idFieldLineageQuotas, quotas)
+	}
+
+	return data
+}
+
+// tokenIDString returns the hex representation of the token id, which is used
+// in the public api.
+func (id *identifier) tokenIDString() string {
+	return hex.EncodeToString(id.tokenID)
+}
+
+// principal returns the name of the principal within which nonces of the
+// token have to be unique. All tokens of the application share the same nonce
+// space, legacy tokens use the nonce space of the user. Child tokens are
+// handed to the delegates which couldn't coordinate nonces with the parent,
+// so that every child token has its own nonce space.
+func (id *identifier) principal() string {
+	if len(id.lineage) != 0 {
+		return fmt.Sprintf("token_%v", id.tokenIDString())
+	}
+
+	if id.applicationID != 0 {
+		return fmt.Sprintf("app_%v", id.applicationID)
+	}
+
+	return fmt.Sprintf("user_%v", id.userID)
+}
+
+// decodeIdentifier parses the macaroon id, both in the current and legacy
+// format.
+func decodeIdentifier(data []byte) (*identifier, error) {
+	if len(data) == legacyIdentifierSize {
+		userID := binary.BigEndian.Uint32(data)
+		return &identifier{
+			keyID:  0,
+			userID: NumericUserID(uint64(userID)),
+		}, nil
+	}
+
+	if len(data) == 0 {
+		return nil, errors.Errorf("empty macaroon id")
+	}
+
+	if data[0] != identifierVersion {
+		return nil, errors.Errorf("unknown macaroon id version: %v", data[0])
+	}
+
+	fields, err := parseIdentifierFields(data[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identifier{}
+	for typ, value := range fields {
+		switch typ {
+		case idFieldKeyID:
+			id.keyID, err = parseUint32Field(value)
+		case idFieldUserID:
+			id.userID, err = parseNumericUserID(value)
+		case idFieldUserName:
+			if len(value) == 0 {
+				err = errors.Errorf("user id is empty")
+			}
+			id.userID = UserID(value)
+		case idFieldAppID:
+			id.applicationID, err = parseUint32Field(value)
+		case idFieldTokenID:
+			if len(value) != tokenIDSize {
+				err = errors.Errorf("wrong token id size: %v", len(value))
+			}
+			id.tokenID = value
+		case idFieldIssuedAt:
+			var t uint64
+			t, err = parseUint64Field(value)
+			id.issuedAt = time.Unix(0, int64(t))
+		case idFieldLineage:
+			if len(value) == 0 || len(value)%tokenIDSize != 0 {
+				err = errors.Errorf("wrong lineage size: %v", len(value))
+			}
+			for i := 0; i+tokenIDSize <= len(value); i += tokenIDSize {
+				id.lineage = append(id.lineage, value[i:i+tokenIDSize])
+			}
+		case idFieldLineageQuotas:
+			if len(value)%4 != 0 {
+				err = errors.Errorf("wrong lineage quotas size: %v",
+					len(value))
+			}
+			for i := 0; i+4 <= len(value); i += 4 {
+				id.lineageQuotas = append(id.lineageQuotas,
+					binary.BigEndian.Uint32(value[i:]))
+			}
+		default:
+			err = errors.Errorf("unknown macaroon id field: %v", typ)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, numeric := fields[idFieldUserID]
+	_, named := fields[idFieldUserName]
+	switch {
+	case !numeric && !named:
+		return nil, errors.Errorf("macaroon id doesn't contain user id")
+	case numeric && named:
+		return nil, errors.Errorf("macaroon id contains both numeric " +
+			"and string user id")
+	}
+
+	// Quotas which couldn't be attributed to the tokens of the lineage
+	// would be counted as the own quotas of the token, which lifts them.
+	_, hasQuotas := fields[idFieldLineageQuotas]
+	if hasQuotas != (len(id.lineage) != 0) ||
+		len(id.lineageQuotas) != len(id.lineage) {
+
+		return nil, errors.Errorf("macaroon id lineage quotas don't " +
+			"match lineage")
+	}
+
+	return id, nil
+}
+
+// parseIdentifierFields splits encoded fields by their type, repeated fields
+// are not allowed.
+func parseIdentifierFields(data []byte) (map[byte][]byte, error) {
+	fields := make(map[byte][]byte)
+	for len(data) > 0 {
+		typ := data[0]
+		data = data[1:]
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, errors.Errorf("malformed macaroon id field: %v", typ)
+		}
+		data = data[n:]
+
+		if _, ok := fields[typ]; ok {
+			return nil, errors.Errorf("repeated macaroon id field: %v", typ)
+		}
+
+		fields[typ] = data[:length]
+		data = data[length:]
+	}
+
+	return fields, nil
+}
+
+// parseNumericUserID parses user id stored either as 4 or 8 bytes integer.
+func parseNumericUserID(value []byte) (UserID, error) {
+	if len(value) == 4 {
+		return NumericUserID(uint64(binary.BigEndian.Uint32(value))), nil
+	}
+
+	userID, err := parseUint64Field(value)
+	if err != nil {
+		return "", err
+	}
+
+	return NumericUserID(userID), nil
+}
+
+func appendField(data []byte, typ byte, value []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(value)))
+
+	data = append(data, typ)
+	data = append(data, length[:n]...)
+	return append(data, value...)
+}
+
+func appendUint32Field(data []byte, typ byte, value uint32) []byte {
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], value)
+	return appendField(data, typ, v[:])
+}
+
+func parseUint32Field(value []byte) (uint32, error) {
+	if len(value) != 4 {
+		return 0, errors.Errorf("wrong uint32 field size: %v", len(value))
+	}
+
+	return binary.BigEndian.Uint32(value), nil
+}
+
+func appendUint64Field(data []byte, typ byte, value uint64) []byte {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], value)
+	return appendField(data, typ, v[:])
+}
+
+func parseUint64Field(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, errors.Errorf("wrong uint64 field size: %v", len(value))
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdentifierEncoding(t *testing.T) {
+	userIDs := []UserID{
+		"100",
+		NumericUserID(math.MaxUint64),
+		"007",
+		"0f8fad5b-d9cb-469f-a165-70867728950e",
+	}
+
+	for _, userID := range userIDs {
+		id := &identifier{
+			keyID:         7,
+			applicationID: 3,
+			userID:        userID,
+			tokenID:       bytes.Repeat([]byte{1}, tokenIDSize),
+			issuedAt:      time.Unix(0, 1540000000000000000),
+			lineage: [][]byte{
+				bytes.Repeat([]byte{2}, tokenIDSize),
+				bytes.Repeat([]byte{3}, tokenIDSize),
+			},
+			lineageQuotas: []uint32{0, 2},
+		}
+
+		decodedID, err := decodeIdentifier(id.encode())
+		if err != nil {
+			t.Fatalf("(%v) unable to decode identifier: %v", userID, err)
+		}
+
+		if !reflect.DeepEqual(decodedID, id) {
+			t.Fatalf("(%v) identifiers are not equal: %v, %v", userID,
+				decodedID, id)
+		}
+
+		if !bytes.Equal(decodedID.encode(), id.encode()) {
+			t.Fatalf("(%v) encoding is not deterministic", userID)
+		}
+	}
+}
+
+func TestNumericUserIDEncoding(t *testing.T) {
+	// Numeric user id which fits in uint32 should be encoded the same way
+	// as before string user ids have been introduced.
+	var data []byte
+	data = append(data, identifierVersion)
+	data = appendUint32Field(data, idFieldKeyID, 1)
+	data = appendUint32Field(data, idFieldUserID, 100)
+
+	id := &identifier{keyID: 1, userID: "100"}
+	if !bytes.Equal(id.encode(), data) {
+		t.Fatalf("wrong encoding: %x, expected %x", id.encode(), data)
+	}
+
+	// Identifier with both numeric and string user ids is ambiguous.
+	data = appendField(data, idFieldUserName, []byte("100"))
+	if _, err := decodeIdentifier(data); err == nil {
+		t.Fatalf("expected to fail on ambiguous user id")
+	}
+}
+
+func TestIdentifierFormat(t *testing.T) {
+	// Encoding is part of the issued tokens, so it shouldn't be changed
+	// in backward incompatible way.
+	id := &identifier{
+		keyID:         7,
+		applicationID: 3,
+		userID:        "100",
+		tokenID:       bytes.Repeat([]byte{1}, tokenIDSize),
+		issuedAt:      time.Unix(0, 1540000000000000000),
+	}
+
+	expected, _ := hex.DecodeString("01" +
+		"010400000007" +
+		"020400000064" +
+		"050400000003" +
+		"031001010101010101010101010101010101" +
+		"0408155f2dd73a1a0000")
+
+	if data := id.encode(); !bytes.Equal(data, expected) {
+		t.Fatalf("wrong encoding: %x, expected %x", data, expected)
+	}
+}
+
+func TestLegacyIdentifier(t *testing.T) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], 100)
+
+	id, err := decodeIdentifier(data[:])
+	if err != nil {
+		t.Fatalf("unable to decode legacy identifier: %v", err)
+	}
+
+	if id.userID != "100" || id.keyID != 0 {
+		t.Fatalf("wrong legacy identifier: %v", id)
+	}
+}
+
+func TestMalformedIdentifier(t *testing.T) {
+	id := (&identifier{userID: "100"}).encode()
+
+	// Child token identifier without quotas of its lineage.
+	lineage := appendField(append([]byte{}, id...), idFieldLineage,
+		bytes.Repeat([]byte{2}, tokenIDSize))
+
+	malformed := [][]byte{
+		nil,
+		{identifierVersion + 1},
+		id[:len(id)-1],
+		append(id, id[1:]...),
+		{identifierVersion},
+		lineage,
+		appendField(lineage, idFieldLineageQuotas, make([]byte, 8)),
+		appendUint32Field(append([]byte{}, id...),
+			idFieldLineageQuotas, 0),
+	}
+
+	for i, data := range malformed {
+		if _, err := decodeIdentifier(data); err == nil {
+			t.Fatalf("(%v) expected to fail on malformed identifier", i)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Package dbtest contains the test suite which is shared by all
+// implementations of auth.DB.
+package dbtest
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+)
+
+// TestDB runs the suite against the database created by newDB, every test
+// case receives a fresh and empty database, which is destroyed by the
+// returned cleanup function.
+func TestDB(t *testing.T, newDB func(t *testing.T) (auth.DB, func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db auth.DB)
+	}{
+		{"RootKeys", testRootKeys},
+		{"Nonces", testNonces},
+		{"NonceStates", testNonceStates},
+		{"Spendings", testSpendings},
+		{"Revocation", testRevocation},
+		{"Applications", testApplications},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, cleanup := newDB(t)
+			defer cleanup()
+
+			test.test(t, db)
+		})
+	}
+}
+
+func testRootKeys(t *testing.T, db auth.DB) {
+	if _, err := db.GetRootKey(); err != auth.ErrRootKeyNotFound {
+		t.Fatalf("expected root key not found error: %v", err)
+	}
+
+	if err := db.PutRootKey([]byte("first")); err != nil {
+		t.Fatalf("unable to put root key: %v", err)
+	}
+
+	if err := db.PutRootKey([]byte("second")); err != nil {
+		t.Fatalf("unable to put root key: %v", err)
+	}
+
+	key, err := db.GetRootKey()
+	if err != nil {
+		t.Fatalf("unable to get root key: %v", err)
+	}
+
+	if key.ID != 1 || !bytes.Equal(key.Key, []byte("second")) ||
+		key.IsRetired() {
+		t.Fatalf("wrong current root key: %v", key)
+	}
+
+	key, err = db.GetRootKeyByID(0)
+	if err != nil {
+		t.Fatalf("unable to get root key: %v", err)
+	}
+
+	if key.ID != 0 || !bytes.Equal(key.Key, []byte("first")) ||
+		!key.IsRetired() {
+		t.Fatalf("wrong retired root key: %v", key)
+	}
+
+	if _, err := db.GetRootKeyByID(2); err != auth.ErrRootKeyNotFound {
+		t.Fatalf("expected root key not found error: %v", err)
+	}
+}
+
+func testNonces(t *testing.T, db auth.DB) {
+	used, err := db.UseNonce("app_1", 10, time.Now())
+	if err != nil {
+		t.Fatalf("unable to use nonce: %v", err)
+	} else if used {
+		t.Fatalf("nonce shouldn't be used")
+	}
+
+	used, err = db.UseNonce("app_1", 10, time.Now())
+	if err != nil {
+		t.Fatalf("unable to use nonce: %v", err)
+	} else if !used {
+		t.Fatalf("nonce should be used")
+	}
+
+	// Nonce spaces of principals are independent.
+	used, err = db.UseNonce("app_2", 10, time.Now())
+	if err != nil {
+		t.Fatalf("unable to use nonce: %v", err)
+	} else if used {
+		t.Fatalf("nonce shouldn't be used")
+	}
+}
+
+func testNonceStates(t *testing.T, db auth.DB) {
+	err := db.UpdateNonceState("app_1", func(state []byte) ([]byte, error) {
+		if state != nil {
+			t.Fatalf("initial state should be nil: %v", state)
+		}
+
+		return []byte("first"), nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update nonce state: %v", err)
+	}
+
+	// If update function fails state should be kept.
+	updateErr := errors.New("update error")
+	err = db.UpdateNonceState("app_1", func(state []byte) ([]byte, error) {
+		return []byte("second"), updateErr
+	})
+	if err != updateErr {
+		t.Fatalf("expected update error: %v", err)
+	}
+
+	err = db.UpdateNonceState("app_1", func(state []byte) ([]byte, error) {
+		if !bytes.Equal(state, []byte("first")) {
+			t.Fatalf("wrong state: %s", state)
+		}
+
+		return []byte("third"), nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update nonce state: %v", err)
+	}
+
+	// States of principals are independent.
+	err = db.UpdateNonceState("app_2", func(state []byte) ([]byte, error) {
+		if state != nil {
+			t.Fatalf("initial state should be nil: %v", state)
+		}
+
+		return []byte("first"), nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update nonce state: %v", err)
+	}
+
+	// Concurrent updates shouldn't be lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := db.UpdateNonceState("counter", func(state []byte) ([]byte,
+				error) {
+
+				return append(state, 1), nil
+			})
+			if err != nil {
+				t.Errorf("unable to update nonce state: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = db.UpdateNonceState("counter", func(state []byte) ([]byte, error) {
+		if len(state) != 10 {
+			t.Fatalf("concurrent updates have been lost: %v", len(state))
+		}
+
+		return state, nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update nonce state: %v", err)
+	}
+}
+
+func testSpendings(t *testing.T, db auth.DB) {
+	expiresAt := time.Now().Add(time.Hour)
+
+	err := db.UpdateSpending("token", expiresAt, func(spent uint64) (uint64,
+		error) {
+
+		if spent != 0 {
+			t.Fatalf("initial amount should be zero: %v", spent)
+		}
+
+		return 100, nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update spending: %v", err)
+	}
+
+	// If update function fails amount should be kept.
+	updateErr := errors.New("update error")
+	err = db.UpdateSpending("token", expiresAt, func(spent uint64) (uint64,
+		error) {
+
+		return 200, updateErr
+	})
+	if err != updateErr {
+		t.Fatalf("expected update error: %v", err)
+	}
+
+	// Amount should be stored without loss of precision.
+	err = db.UpdateSpending("token", expiresAt, func(spent uint64) (uint64,
+		error) {
+
+		if spent != 100 {
+			t.Fatalf("wrong amount: %v", spent)
+		}
+
+		return math.MaxUint64, nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update spending: %v", err)
+	}
+
+	err = db.UpdateSpending("token", expiresAt, func(spent uint64) (uint64,
+		error) {
+
+		if spent != math.MaxUint64 {
+			t.Fatalf("wrong amount: %v", spent)
+		}
+
+		return 0, nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update spending: %v", err)
+	}
+
+	// Concurrent updates shouldn't be lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := db.UpdateSpending("counter", expiresAt,
+				func(spent uint64) (uint64, error) {
+					return spent + 1, nil
+				})
+			if err != nil {
+				t.Errorf("unable to update spending: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = db.UpdateSpending("counter", expiresAt, func(spent uint64) (uint64,
+		error) {
+
+		if spent != 10 {
+			t.Fatalf("concurrent updates have been lost: %v", spent)
+		}
+
+		return spent, nil
+	})
+	if err != nil {
+		t.Fatalf("unable to update spending: %v", err)
+	}
+}
+
+func testRevocation(t *testing.T, db auth.DB) {
+	if revoked, err := db.IsTokenRevoked("kek"); err != nil {
+		t.Fatalf("unable to check token revocation: %v", err)
+	} else if revoked {
+		t.Fatalf("token shouldn't be revoked")
+	}
+
+	if err := db.RevokeToken("kek"); err != nil {
+		t.Fatalf("unable to revoke token: %v", err)
+	}
+
+	if revoked, err := db.IsTokenRevoked("kek"); err != nil {
+		t.Fatalf("unable to check token revocation: %v", err)
+	} else if !revoked {
+		t.Fatalf("token should be revoked")
+	}
+
+	// Both numeric and string user ids should be supported.
+	userIDs := []auth.UserID{
+		"1",
+		auth.NumericUserID(math.MaxUint64),
+		"0f8fad5b-d9cb-469f-a165-70867728950e",
+	}
+
+	for _, userID := range userIDs {
+		revocationTime, err := db.GetUserRevocationTime(userID)
+		if err != nil {
+			t.Fatalf("unable to get revocation time: %v", err)
+		} else if !revocationTime.IsZero() {
+			t.Fatalf("user tokens shouldn't be revoked")
+		}
+
+		now := time.Now()
+		if err := db.RevokeUserTokens(userID, now); err != nil {
+			t.Fatalf("unable to revoke user tokens: %v", err)
+		}
+
+		// Revocation time couldn't be moved backward.
+		err = db.RevokeUserTokens(userID, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("unable to revoke user tokens: %v", err)
+		}
+
+		revocationTime, err = db.GetUserRevocationTime(userID)
+		if err != nil {
+			t.Fatalf("unable to get revocation time: %v", err)
+		} else if !revocationTime.Equal(now) {
+			t.Fatalf("wrong revocation time: %v, expected %v",
+				revocationTime, now)
+		}
+	}
+}
+
+func testApplications(t *testing.T, db auth.DB) {
+	if _, err := db.GetApplication(1); err != auth.ErrApplicationNotFound {
+		t.Fatalf("expected application not found error: %v", err)
+	}
+
+	first := &auth.Application{
+		Name:        "bot",
+		UserID:      "1",
+		CreatedAt:   time.Unix(1540000000, 0),
+		Description: "trading bot",
+	}
+
+	second := &auth.Application{
+		Name:      "wallet",
+		UserID:    "0f8fad5b-d9cb-469f-a165-70867728950e",
+		CreatedAt: time.Unix(1540000000, 0),
+	}
+
+	for _, app := range []*auth.Application{first, second} {
+		if err := db.PutApplication(app); err != nil {
+			t.Fatalf("unable to put application: %v", err)
+		}
+	}
+
+	if first.ID == 0 || second.ID == 0 || first.ID == second.ID {
+		t.Fatalf("wrong application ids: %v, %v", first.ID, second.ID)
+	}
+
+	app, err := db.GetApplication(first.ID)
+	if err != nil {
+		t.Fatalf("unable to get application: %v", err)
+	}
+
+	if app.ID != first.ID || app.Name != first.Name ||
+		app.UserID != first.UserID || !app.CreatedAt.Equal(first.CreatedAt) ||
+		app.Description != first.Description {
+		t.Fatalf("wrong application: %v, expected %v", app, first)
+	}
+
+	apps, err := db.GetUserApplications(second.UserID)
+	if err != nil {
+		t.Fatalf("unable to get user applications: %v", err)
+	}
+
+	if len(apps) != 1 || apps[0].ID != second.ID {
+		t.Fatalf("wrong user applications: %v", apps)
+	}
+}
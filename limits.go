@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon.v2"
+)
+
+// quotaPeriod is the period of time within which daily quota is counted,
+// periods start at midnight UTC.
+const quotaPeriod = 24 * time.Hour
+
+// Limit caveats restrict the amount of funds which operation is permitted to
+// spend, e.g. the wallet application might be permitted to withdraw at most
+// 100 units per request and 1000 units per day. Caveat value consists of the
+// operation pattern, which is matched with the same rules as allowed
+// operations, and the amount separated by colon, e.g. "wallet.withdraw:100".
+// If several limits match the operation, all of them should be satisfied.
+
+// limit is the decoded value of the limit caveat.
+type limit struct {
+	operation string
+	amount    uint64
+
+	// index is the position of the caveat among the token caveats of the
+	// same kind.
+	index int
+}
+
+// AddAmountLimit restricts the amount which could be spent by the single
+// operation matching the given pattern.
+func AddAmountLimit(m *macaroon.Macaroon, operation string,
+	amount uint64) (*macaroon.Macaroon, error) {
+
+	return addLimit(m, AmountLimitPrefix, operation, amount)
+}
+
+// AddDailyQuota restricts the total amount which could be spent by the
+// operations matching the given pattern within the day. Quota is tracked by
+// the server per token.
+func AddDailyQuota(m *macaroon.Macaroon, operation string,
+	amount uint64) (*macaroon.Macaroon, error) {
+
+	return addLimit(m, DailyQuotaPrefix, operation, amount)
+}
+
+func addLimit(m *macaroon.Macaroon, key, operation string,
+	amount uint64) (*macaroon.Macaroon, error) {
+
+	value := encodeLimit(limit{operation: operation, amount: amount})
+	if err := checkLimitCaveat(value); err != nil {
+		return nil, err
+	}
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(key, value)
+}
+
+func encodeLimit(l limit) string {
+	return l.operation + ":" + strconv.FormatUint(l.amount, 10)
+}
+
+func decodeLimit(value string) (limit, error) {
+	i := strings.LastIndex(value, ":")
+	if i == -1 {
+		return limit{}, errors.Errorf("malformed limit: %q", value)
+	}
+
+	amount, err := strconv.ParseUint(value[i+1:], 10, 64)
+	if err != nil {
+		return limit{}, err
+	}
+
+	return limit{operation: value[:i], amount: amount}, nil
+}
+
+func checkLimitCaveat(value string) error {
+	l, err := decodeLimit(value)
+	if err != nil {
+		return err
+	}
+
+	return validateOperations([]string{l.operation})
+}
+
+// matchingLimits returns limits of the given kind which apply to the
+// operation. Malformed pattern matches any operation, so that mistake in the
+// pattern couldn't lift the limit.
+func matchingLimits(m *macaroon.Macaroon, key, operation string) ([]limit,
+	error) {
+
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := md.GetAll(key)
+	if err == ErrFieldNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var limits []limit
+	for i, value := range values {
+		l, err := decodeLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		l.index = i
+
+		if matchOperations([]string{l.operation}, operation, true) {
+			limits = append(limits, l)
+		}
+	}
+
+	return limits, nil
+}
+
+// CheckLimit checks that the given amount could be spent by the operation
+// and, if token has daily quotas, records the spending. Operation itself
+// should be authorized separately with IsAuthorized.
+func (t *Token) CheckLimit(operation string, amount uint64) error {
+	limits, err := matchingLimits(t.macaroon, AmountLimitPrefix, operation)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range limits {
+		if amount > l.amount {
+			return ErrAmountLimitExceeded
+		}
+	}
+
+	quotas, err := matchingLimits(t.macaroon, DailyQuotaPrefix, operation)
+	if err != nil {
+		return err
+	}
+
+	now := t.auth.clock.Now().UTC()
+	period := now.Truncate(quotaPeriod)
+	expiresAt := period.Add(quotaPeriod)
+
+	// Quotas with the same pattern introduced by the same token share the
+	// spending counter, so only the smallest of them has to be checked.
+	var keys []string
+	quotaAmounts := make(map[string]uint64)
+	for _, q := range quotas {
+		key := spendingKey(t.quotaOwner(q.index), q.operation, period)
+		current, ok := quotaAmounts[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+
+		if !ok || q.amount < current {
+			quotaAmounts[key] = q.amount
+		}
+	}
+
+	for i, key := range keys {
+		quota := quotaAmounts[key]
+		err := t.auth.db.UpdateSpending(key, expiresAt, func(spent uint64) (
+			uint64, error) {
+
+			if amount > quota || spent > quota-amount {
+				return 0, ErrQuotaExceeded
+			}
+
+			return spent + amount, nil
+		})
+		if err == nil {
+			continue
+		}
+
+		// Return the amount to the quotas which have been already charged,
+		// refund error is ignored because it only makes quota stricter.
+		for _, charged := range keys[:i] {
+			t.auth.db.UpdateSpending(charged, expiresAt, func(spent uint64) (
+				uint64, error) {
+
+				if spent < amount {
+					return 0, nil
+				}
+
+				return spent - amount, nil
+			})
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// quotaOwner returns the id of the token which has introduced the daily
+// quota with the given index. Child token inherits quotas from the root of
+// the lineage down to the parent before its own ones, so that quota is shared
+// by the token which has introduced it and all its descendants, but not by
+// its siblings. Legacy tokens don't have id, so their spendings are counted
+// within the principal.
+func (t *Token) quotaOwner(index int) string {
+	for i := len(t.lineage) - 1; i >= 0; i-- {
+		if index < int(t.lineageQuotas[i]) {
+			return hex.EncodeToString(t.lineage[i])
+		}
+		index -= int(t.lineageQuotas[i])
+	}
+
+	if t.id == "" {
+		return t.principal
+	}
+
+	return t.id
+}
+
+// spendingKey returns the key of the spending counter of the quota
+// introduced by the given token within the given period.
+func spendingKey(owner, pattern string, period time.Time) string {
+	return fmt.Sprintf("%v:%v:%v", owner, pattern, period.Format("2006-01-02"))
+}
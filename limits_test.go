@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAmountLimits(t *testing.T) {
+	clock := NewFakeClock(time.Date(2018, 10, 20, 23, 0, 0, 0, time.UTC))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	auth, err := NewAuth("", db, TimeSource(clock))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		AmountLimit("wallet.withdraw", 100),
+		DailyQuota("wallet", 250))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Client narrows the quota of withdrawals before passing the token to
+	// the bot.
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	m, err = AddDailyQuota(m, "wallet.withdraw", 150)
+	if err != nil {
+		t.Fatalf("unable to add daily quota: %v", err)
+	}
+
+	m, err = AddNonce(m, 1)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	m, err = AddCurrentTimeFrom(m, clock)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	tokenStr, err = EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	token, err := auth.ExtractToken(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	steps := []struct {
+		operation string
+		amount    uint64
+		err       error
+	}{
+		{"wallet.withdraw", 101, ErrAmountLimitExceeded},
+		{"wallet.withdraw", 100, nil},
+		{"wallet.withdraw", 60, ErrQuotaExceeded},
+		{"wallet.withdraw", 50, nil},
+
+		// Failed operation shouldn't be charged to the wider quota.
+		{"wallet.send", 100, nil},
+		{"wallet.send", 1, ErrQuotaExceeded},
+
+		// Operations without limits are not restricted.
+		{"exchange.trade", 1000, nil},
+	}
+
+	for i, step := range steps {
+		err := token.CheckLimit(step.operation, step.amount)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+
+	// Quota is restored on the next day.
+	clock.Advance(time.Hour)
+
+	if err := token.CheckLimit("wallet.withdraw", 100); err != nil {
+		t.Fatalf("quota should be restored: %v", err)
+	}
+}
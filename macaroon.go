@@ -4,12 +4,37 @@ import (
 	"gopkg.in/macaroon.v2"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"encoding/hex"
+	"github.com/go-errors/errors"
 )
 
+// restrictionFields are the fields which could be repeated in the macaroon.
+// Every next occurrence of the field could only narrow the restriction, so
+// that holder of the macaroon is able to attenuate it before passing it to
+// another party. All other fields, such as user, time and nonce, identify
+// the request and should be unique.
+var restrictionFields = map[string]struct{}{
+	DisabledOperationPrefix: {},
+	AllowedOperationPrefix:  {},
+	ExpiresPrefix:           {},
+	NotBeforePrefix:         {},
+	LifetimePrefix:          {},
+	AllowedResourcePrefix:   {},
+	AmountLimitPrefix:       {},
+	DailyQuotaPrefix:        {},
+	AllowedAddressPrefix:    {},
+}
+
+// isRestrictionField returns true if field could be repeated.
+func isRestrictionField(key string) bool {
+	_, ok := restrictionFields[key]
+	return ok
+}
+
 // MacaroonDictionary macaroon where conditions are represented as fields.
 // This type of macaroon represents dictionary with ability to check that
 // modification has been made and that original dictionary was created by us.
 // Such representation allows divide the extraction and validation logic.
+// Restriction fields might have several values, which should be intersected.
 type MacaroonDictionary struct {
 	*macaroon.Macaroon
 }
@@ -27,13 +52,15 @@ func NewMacaroonDictionary(m *macaroon.Macaroon) (*MacaroonDictionary, error) {
 }
 
 // Put puts field in the macaroon and updates the macaroon signature.
+// Restriction fields are appended to the previous values of the field, other
+// fields couldn't be put twice.
 func (md *MacaroonDictionary) Put(key, value string) error {
 	fields, err := caveatsToMap(md.Caveats())
 	if err != nil {
 		return err
 	}
 
-	if _, ok := fields[key]; ok {
+	if _, ok := fields[key]; ok && !isRestrictionField(key) {
 		return ErrFieldExist
 	}
 
@@ -41,18 +68,30 @@ func (md *MacaroonDictionary) Put(key, value string) error {
 	return md.AddFirstPartyCaveat([]byte(caveat))
 }
 
-// Get gets the macaroon fields by its key.
+// Get gets the macaroon fields by its key. For restriction fields the first
+// value is returned, use GetAll to obtain all of them.
 func (md *MacaroonDictionary) Get(key string) (string, error) {
-	fields, err := caveatsToMap(md.Caveats())
+	values, err := md.GetAll(key)
 	if err != nil {
 		return "", err
 	}
 
-	if value, ok := fields[key]; ok {
-		return value, nil
+	return values[0], nil
+}
+
+// GetAll gets all values of the macaroon field in the order they have been
+// added.
+func (md *MacaroonDictionary) GetAll(key string) ([]string, error) {
+	fields, err := caveatsToMap(md.Caveats())
+	if err != nil {
+		return nil, err
+	}
+
+	if values, ok := fields[key]; ok {
+		return values, nil
 	}
 
-	return "", ErrFieldNotFound
+	return nil, ErrFieldNotFound
 }
 
 // DecodeMacaroon is used by client applications to decode the given macaroon.
@@ -70,6 +109,38 @@ func DecodeMacaroon(macaroonStr string) (*macaroon.Macaroon, error) {
 	return m, nil
 }
 
+// DecodeMacaroons decodes the token which consists of the macaroon followed
+// by the bound discharge macaroons, token without discharges is decoded as
+// the slice of single macaroon.
+func DecodeMacaroons(macaroonsStr string) (macaroon.Slice, error) {
+	data, err := hex.DecodeString(macaroonsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms macaroon.Slice
+	if err := ms.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	if len(ms) == 0 {
+		return nil, errors.Errorf("empty token")
+	}
+
+	return ms, nil
+}
+
+// EncodeMacaroons is used by client application to encode the macaroon
+// together with bound discharge macaroons.
+func EncodeMacaroons(ms macaroon.Slice) (string, error) {
+	data, err := ms.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
 // EncodeMacaroon is used by client application to convert macaroon back to
 // byte representation.
 func EncodeMacaroon(m *macaroon.Macaroon) (string, error) {
@@ -81,19 +152,24 @@ func EncodeMacaroon(m *macaroon.Macaroon) (string, error) {
 	return hex.EncodeToString(data), nil
 }
 
-func caveatsToMap(caveats []macaroon.Caveat) (map[string]string, error) {
-	fields := make(map[string]string, len(caveats))
+func caveatsToMap(caveats []macaroon.Caveat) (map[string][]string, error) {
+	fields := make(map[string][]string, len(caveats))
 	for _, c := range caveats {
+		// Third-party caveats are checked by discharge macaroons.
+		if isThirdPartyCaveat(c) {
+			continue
+		}
+
 		k, v, err := checkers.ParseCaveat(string(c.Id))
 		if err != nil {
 			return nil, err
 		}
 
-		if _, ok := fields[k]; ok {
+		if _, ok := fields[k]; ok && !isRestrictionField(k) {
 			return nil, ErrRepeatedField
 		}
 
-		fields[k] = v
+		fields[k] = append(fields[k], v)
 	}
 
 	return fields, nil
@@ -57,3 +57,44 @@ func TestRepeatedConditionOnInit(t *testing.T) {
 		t.Fatalf("expected receive repeated field value")
 	}
 }
+
+func TestRepeatedRestrictionField(t *testing.T) {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		t.Fatalf("unable to create macaron dictionary: %v", err)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		if err := md.Put(DisabledOperationPrefix, value); err != nil {
+			t.Fatalf("unable to put restriction field: %v", err)
+		}
+	}
+
+	if _, err := NewMacaroonDictionary(m); err != nil {
+		t.Fatalf("repeated restriction field should be allowed: %v", err)
+	}
+
+	values, err := md.GetAll(DisabledOperationPrefix)
+	if err != nil {
+		t.Fatalf("unable to get field values: %v", err)
+	}
+
+	if len(values) != 2 || values[0] != "first" || values[1] != "second" {
+		t.Fatalf("wrong field values: %v", values)
+	}
+
+	// Identity fields should remain unique.
+	if err := md.Put(UserPrefix, "1"); err != nil {
+		t.Fatalf("unable to put field: %v", err)
+	}
+
+	if err := md.Put(UserPrefix, "2"); err != ErrFieldExist {
+		t.Fatalf("repeated identity field shouldn't be allowed: %v", err)
+	}
+}
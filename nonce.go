@@ -1,18 +1,23 @@
 package auth
 
 import (
+	"encoding/binary"
+	"math/big"
 	"strconv"
 	"time"
+	"github.com/go-errors/errors"
 	"gopkg.in/macaroon.v2"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 )
 
-// MacaroonLifetime is the period of time during which macaroon remains
+// MacaroonLifetime is the default period of time during which macaroon remains
 // fresh, after that we believe that it is outdated and could remove stored
 // nonce. With this we could have a in-memory nonce database because even if
 // service goes down, attacker couldn't reuse the token after lifetime.
 //
-// NOTE: If time becomes greater than possible service downtime we should
-// implement persistent nonce database.
+// NOTE: If time becomes greater than possible service downtime persistent
+// nonce database, such as boltdb.DB, should be used. Lifetime is read once on
+// auth creation, use RequestLifetime option to configure it.
 var MacaroonLifetime = 5 * time.Second
 
 // AddNonce is used by the client application to add nonce,
@@ -33,20 +38,151 @@ func AddNonce(m *macaroon.Macaroon, nonce int64) (*macaroon.Macaroon, error) {
 // configured macaroon become expired. This field is need to protect client from
 // replay-attack.
 func AddCurrentTime(m *macaroon.Macaroon) (*macaroon.Macaroon, error) {
+	return AddCurrentTimeFrom(m, SystemClock)
+}
+
+// AddCurrentTimeFrom is the same as AddCurrentTime but takes the current time
+// from the given clock.
+func AddCurrentTimeFrom(m *macaroon.Macaroon,
+	clock Clock) (*macaroon.Macaroon, error) {
+
 	newMac := m.Clone()
 	md, err := NewMacaroonDictionary(newMac)
 	if err != nil {
 		return nil, err
 	}
 
-	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	now := strconv.FormatInt(clock.Now().UnixNano(), 10)
 	return newMac, md.Put(TimePrefix, now)
 }
 
-// CheckNonce checks that nonce hasn't been used twice. With this we protect
-// user form replay-attack.
-func CheckNonce(m *macaroon.Macaroon, id uint32, db DB,
+// AddRequestLifetime sets the period of time during which request made with
+// the macaroon remains fresh. If it is added by the server on token
+// generation it overrides the default lifetime, if it is added by the client
+// it could only shorten the lifetime.
+func AddRequestLifetime(m *macaroon.Macaroon,
+	lifetime time.Duration) (*macaroon.Macaroon, error) {
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(LifetimePrefix, strconv.FormatInt(int64(lifetime),
+		10))
+}
+
+// requestLifetime returns the freshness lifetime of the request made with the
+// macaroon. Lifetime caveat added by the server, i.e. before the user caveat,
+// overrides the default lifetime, while lifetime caveats added by the client
+// after it are only able to shorten it.
+func requestLifetime(m *macaroon.Macaroon,
+	defaultLifetime time.Duration) (time.Duration, error) {
+
+	lifetime := defaultLifetime
+	addedByClient := false
+	for _, c := range m.Caveats() {
+		if isThirdPartyCaveat(c) {
+			continue
+		}
+
+		key, value, err := checkers.ParseCaveat(string(c.Id))
+		if err != nil {
+			return 0, err
+		}
+
+		switch key {
+		case UserPrefix:
+			addedByClient = true
+
+		case LifetimePrefix:
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+
+			if !addedByClient || time.Duration(v) < lifetime {
+				lifetime = time.Duration(v)
+			}
+		}
+	}
+
+	return lifetime, nil
+}
+
+// ReplayMode defines how the nonce is checked for reuse.
+type ReplayMode uint8
+
+const (
+	// ExactNonceMatch rejects the nonce only if exactly the same nonce has
+	// been used by the principal within macaroon lifetime. Nonces could
+	// arrive in any order.
+	ExactNonceMatch ReplayMode = iota
+
+	// IncreasingNonce requires every nonce to be greater than the last
+	// accepted nonce of the principal, database keeps only this high-water
+	// mark, so nonces are protected from reuse even after macaroon lifetime.
+	IncreasingNonce
+
+	// SlidingWindowNonce accepts the nonce if it is greater than the last
+	// accepted nonce of the principal, or if it is within the window below
+	// it and hasn't been seen yet. This allows concurrent requests to
+	// arrive out of order, the same way as IPsec anti-replay window.
+	SlidingWindowNonce
+)
+
+// DefaultMaxClockSkew is the default maximum difference between client and
+// server clocks which is tolerated during the macaroon time check.
+const DefaultMaxClockSkew = time.Second
+
+// DefaultNonceWindowSize is the default size of the sliding window in
+// nonces.
+const DefaultNonceWindowSize = 64
+
+// NonceChecker checks the time and nonce caveats of the macaroon.
+type NonceChecker struct {
+	// DB is used to keep track of used nonces.
+	DB DB
+
+	// Lifetime is the period of time during which macaroon remains fresh.
+	Lifetime time.Duration
+
+	// Mode defines how the nonce is checked for reuse.
+	Mode ReplayMode
+
+	// WindowSize is the number of nonces below the last accepted nonce
+	// which are tracked in SlidingWindowNonce mode, zero means
+	// DefaultNonceWindowSize.
+	WindowSize uint
+
+	// Clock is used to obtain the current time, nil means SystemClock.
+	Clock Clock
+
+	// MaxSkew is the maximum difference between client and server clocks.
+	// Macaroons created further in the future are rejected, and the same
+	// tolerance is applied to the macaroon expiration.
+	MaxSkew time.Duration
+}
+
+// CheckNonce checks that nonce hasn't been used twice within the given
+// principal. With this we protect user form replay-attack. Clock skew isn't
+// tolerated, use NonceChecker to configure it.
+func CheckNonce(m *macaroon.Macaroon, principal string, db DB,
 	lifetime time.Duration) error {
+
+	checker := &NonceChecker{
+		DB:       db,
+		Lifetime: lifetime,
+		Mode:     ExactNonceMatch,
+	}
+
+	return checker.Check(m, principal)
+}
+
+// Check checks that macaroon hasn't expired and that nonce hasn't been used
+// within the given principal.
+func (c *NonceChecker) Check(m *macaroon.Macaroon, principal string) error {
 	md, err := NewMacaroonDictionary(m)
 	if err != nil {
 		return err
@@ -65,8 +201,21 @@ func CheckNonce(m *macaroon.Macaroon, id uint32, db DB,
 
 	creationTime := time.Unix(0, t)
 
-	expirationTime := creationTime.Add(lifetime)
-	if time.Now().After(expirationTime) {
+	clock := c.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	// Client clock might be ahead or behind of ours, so we tolerate the skew
+	// in both directions, but otherwise macaroon from the future would
+	// remain fresh longer than its lifetime.
+	now := clock.Now()
+	if creationTime.After(now.Add(c.MaxSkew)) {
+		return ErrMacaroonFromFuture
+	}
+
+	expirationTime := creationTime.Add(c.Lifetime + c.MaxSkew)
+	if now.After(expirationTime) {
 		return ErrMacaroonExpired
 	}
 
@@ -82,9 +231,132 @@ func CheckNonce(m *macaroon.Macaroon, id uint32, db DB,
 		return err
 	}
 
-	if db.UseNonce(id, macaroonNonce) {
-		return ErrNonceUsed
+	switch c.Mode {
+	case ExactNonceMatch:
+		// Nonce should be kept while request is fresh, including the
+		// tolerated skew.
+		used, err := c.DB.UseNonce(principal, macaroonNonce, expirationTime)
+		if err != nil {
+			return err
+		}
+
+		if used {
+			return ErrNonceUsed
+		}
+
+		return nil
+
+	case IncreasingNonce:
+		return c.DB.UpdateNonceState(principal, func(state []byte) ([]byte,
+			error) {
+
+			return useIncreasingNonce(state, macaroonNonce)
+		})
+
+	case SlidingWindowNonce:
+		windowSize := c.WindowSize
+		if windowSize == 0 {
+			windowSize = DefaultNonceWindowSize
+		}
+
+		return c.DB.UpdateNonceState(principal, func(state []byte) ([]byte,
+			error) {
+
+			return useWindowNonce(state, macaroonNonce, windowSize)
+		})
+
+	default:
+		return errors.Errorf("unknown replay mode: %v", c.Mode)
+	}
+}
+
+// useIncreasingNonce checks that nonce is greater than the high-water mark
+// stored in the nonce state and returns the state with the new mark.
+func useIncreasingNonce(state []byte, nonce int64) ([]byte, error) {
+	if state != nil {
+		if len(state) < 8 {
+			return nil, errors.Errorf("malformed nonce state")
+		}
+
+		lastNonce := int64(binary.BigEndian.Uint64(state))
+		if nonce <= lastNonce {
+			return nil, ErrNonceTooLow
+		}
 	}
 
-	return nil
+	newState := make([]byte, 8)
+	binary.BigEndian.PutUint64(newState, uint64(nonce))
+	return newState, nil
+}
+
+// useWindowNonce checks that nonce is either greater than the high-water mark
+// or is within the window below it and hasn't been used, and returns the
+// state with the nonce marked as used. State consists of the high-water mark
+// followed by the bitmap, where bit i is set if nonce mark-i has been used.
+func useWindowNonce(state []byte, nonce int64, windowSize uint) ([]byte,
+	error) {
+
+	bitmap := new(big.Int)
+	if state == nil {
+		// This is the first nonce of principal.
+		return encodeWindowState(nonce, bitmap.SetBit(bitmap, 0, 1)), nil
+	}
+
+	if len(state) < 8 {
+		return nil, errors.Errorf("malformed nonce state")
+	}
+
+	lastNonce := int64(binary.BigEndian.Uint64(state))
+	if len(state) == 8 {
+		// State has been written in IncreasingNonce mode, in this case we
+		// don't know which nonces below mark have been used, and consider
+		// them all used.
+		bitmap.Lsh(big.NewInt(1), windowSize)
+		bitmap.Sub(bitmap, big.NewInt(1))
+	} else {
+		bitmap.SetBytes(state[8:])
+	}
+
+	if nonce > lastNonce {
+		// Shift the window so that new nonce becomes the high-water mark,
+		// nonces which fall out of window are forgotten.
+		shift := uint64(nonce) - uint64(lastNonce)
+		if shift >= uint64(windowSize) {
+			bitmap.SetInt64(0)
+		} else {
+			bitmap.Lsh(bitmap, uint(shift))
+			truncateBitmap(bitmap, windowSize)
+		}
+
+		bitmap.SetBit(bitmap, 0, 1)
+		return encodeWindowState(nonce, bitmap), nil
+	}
+
+	offset := uint64(lastNonce) - uint64(nonce)
+	if offset >= uint64(windowSize) {
+		return nil, ErrNonceTooLow
+	}
+
+	if bitmap.Bit(int(offset)) == 1 {
+		return nil, ErrNonceUsed
+	}
+
+	bitmap.SetBit(bitmap, int(offset), 1)
+	return encodeWindowState(lastNonce, bitmap), nil
+}
+
+// truncateBitmap clears all bits of bitmap starting from the given size.
+func truncateBitmap(bitmap *big.Int, size uint) {
+	for i := bitmap.BitLen() - 1; i >= int(size); i-- {
+		bitmap.SetBit(bitmap, i, 0)
+	}
+}
+
+func encodeWindowState(lastNonce int64, bitmap *big.Int) []byte {
+	state := make([]byte, 8)
+	binary.BigEndian.PutUint64(state, uint64(lastNonce))
+
+	// Bitmap is always non-zero, because high-water mark itself is used,
+	// so the state is distinguishable from IncreasingNonce state.
+	return append(state, bitmap.Bytes()...)
 }
@@ -19,7 +19,7 @@ func TestCheckNonceFunction(t *testing.T) {
 	{
 		db := NewInMemoryDB(rootKey, MacaroonLifetime)
 
-		if err := CheckNonce(m, 1, db, MacaroonLifetime); err == nil {
+		if err := CheckNonce(m, "app_1", db, MacaroonLifetime); err == nil {
 			t.Fatalf("expected to fail because don't have time and nonce fields"+
 				": %v", err)
 		}
@@ -36,7 +36,7 @@ func TestCheckNonceFunction(t *testing.T) {
 	{
 		db := NewInMemoryDB(rootKey, MacaroonLifetime)
 
-		if err := CheckNonce(m, 1, db, MacaroonLifetime); err == nil {
+		if err := CheckNonce(m, "app_1", db, MacaroonLifetime); err == nil {
 			t.Fatalf("expected to fail because don't have time field: %v", err)
 		}
 	}
@@ -51,19 +51,17 @@ func TestCheckNonceFunction(t *testing.T) {
 	{
 		db := NewInMemoryDB(rootKey, MacaroonLifetime)
 
-		if err := CheckNonce(m, 1, db, 0); err != ErrMacaroonExpired {
+		if err := CheckNonce(m, "app_1", db, 0); err != ErrMacaroonExpired {
 			t.Fatalf("expected to fail because macaron expired: %v", err)
 		}
 	}
 
 	// Check that check nonce function fail because nonce has been used.
 	{
-		db := &InMemoryDB{
-			nonces:  map[string]time.Time{getKey(1, nonce): time.Now()},
-			rootKey: rootKey,
-		}
+		db := NewInMemoryDB(rootKey, MacaroonLifetime)
+		db.nonces = map[string]time.Time{getKey("app_1", nonce): time.Now()}
 
-		if err := CheckNonce(m, 1, db, MacaroonLifetime); err != ErrNonceUsed {
+		if err := CheckNonce(m, "app_1", db, MacaroonLifetime); err != ErrNonceUsed {
 			t.Fatalf("expected to fail because macaron nonce has been used"+
 				": %v", err)
 		}
@@ -73,7 +71,7 @@ func TestCheckNonceFunction(t *testing.T) {
 	{
 		db := NewInMemoryDB(rootKey, MacaroonLifetime)
 
-		if err := CheckNonce(m, 1, db, MacaroonLifetime); err != nil {
+		if err := CheckNonce(m, "app_1", db, MacaroonLifetime); err != nil {
 			t.Fatalf("unable to check macaroon: %v", err)
 		}
 	}
@@ -86,30 +84,309 @@ func TestNonceFlush(t *testing.T) {
 		t.Fatalf("unable to create macaron: %v", err)
 	}
 
+	clock := NewFakeClock(time.Unix(1540000000, 0))
 	flushPeriod := time.Millisecond * 50
-	db := NewInMemoryDB(rootKey, flushPeriod)
+	db := NewInMemoryDBWithClock(rootKey, flushPeriod, clock)
 
 	// Pretend that nonce was already used
 	nonce := int64(100)
-	userID := uint32(1)
-	db.nonces = map[string]time.Time{getKey(userID, nonce): time.Now()}
+	principal := "app_1"
+	db.nonces = map[string]time.Time{getKey(principal, nonce): clock.Now()}
 
 	m, err = AddNonce(m, nonce)
 	if err != nil {
 		t.Fatalf("unable to add nonce: %v", err)
 	}
 
-	m, err = AddCurrentTime(m)
+	m, err = AddCurrentTimeFrom(m, clock)
 	if err != nil {
 		t.Fatalf("unable to add current time: %v", err)
 	}
 
-	// Start nonce flushing and wait more than flushing period.
+	checker := &NonceChecker{
+		DB:       db,
+		Lifetime: MacaroonLifetime,
+		Clock:    clock,
+	}
+
+	// Start nonce flushing and move time more than flushing period. Flushing
+	// goroutine starts waiting again only after flush is finished.
 	db.StartFlushing()
 	defer db.StopFlushing()
-	time.Sleep(2 * flushPeriod)
 
-	if err := CheckNonce(m, userID, db, MacaroonLifetime); err != nil {
+	clock.BlockUntil(1)
+	clock.Advance(2 * flushPeriod)
+	clock.BlockUntil(1)
+
+	if err := checker.Check(m, principal); err != nil {
 		t.Fatalf("unable to check macaroon: %v", err)
 	}
 }
+
+func TestMacaroonExpiration(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	checker := &NonceChecker{
+		DB:       db,
+		Lifetime: MacaroonLifetime,
+		Clock:    clock,
+	}
+
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AddNonce(m, 1)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	m, err = AddCurrentTimeFrom(m, clock)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	// Macaroon is still fresh at the very end of its lifetime.
+	clock.Advance(MacaroonLifetime)
+
+	if err := checker.Check(m, "app_1"); err != nil {
+		t.Fatalf("macaroon should be fresh: %v", err)
+	}
+
+	clock.Advance(time.Nanosecond)
+
+	if err := checker.Check(m, "app_1"); err != ErrMacaroonExpired {
+		t.Fatalf("macaroon should be expired: %v", err)
+	}
+}
+
+// newFreshMacaroon creates macaroon with the given nonce and current time.
+func newFreshMacaroon(t *testing.T, nonce int64) *macaroon.Macaroon {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AddNonce(m, nonce)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	m, err = AddCurrentTime(m)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	return m
+}
+
+func TestIncreasingNonce(t *testing.T) {
+	checker := &NonceChecker{
+		DB:       NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		Lifetime: MacaroonLifetime,
+		Mode:     IncreasingNonce,
+	}
+
+	steps := []struct {
+		principal string
+		nonce     int64
+		err       error
+	}{
+		{"app_1", 10, nil},
+		{"app_1", 10, ErrNonceTooLow},
+		{"app_1", 5, ErrNonceTooLow},
+		{"app_1", 11, nil},
+		{"app_1", 100, nil},
+		{"app_1", 50, ErrNonceTooLow},
+
+		// Principals have independent high-water marks.
+		{"app_2", 50, nil},
+	}
+
+	for i, step := range steps {
+		err := checker.Check(newFreshMacaroon(t, step.nonce), step.principal)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+}
+
+func TestSlidingWindowNonce(t *testing.T) {
+	checker := &NonceChecker{
+		DB:         NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		Lifetime:   MacaroonLifetime,
+		Mode:       SlidingWindowNonce,
+		WindowSize: 8,
+	}
+
+	steps := []struct {
+		nonce int64
+		err   error
+	}{
+		{10, nil},
+		{10, ErrNonceUsed},
+
+		// Nonces below the mark within the window are accepted once.
+		{8, nil},
+		{9, nil},
+		{8, ErrNonceUsed},
+		{3, nil},
+		{2, ErrNonceTooLow},
+
+		// Move window, so that previously unused nonce falls out of it.
+		{12, nil},
+		{5, nil},
+		{4, ErrNonceTooLow},
+		{11, nil},
+		{11, ErrNonceUsed},
+		{9, ErrNonceUsed},
+
+		// Jump bigger than window forgets all previous nonces.
+		{100, nil},
+		{92, ErrNonceTooLow},
+		{93, nil},
+		{99, nil},
+		{99, ErrNonceUsed},
+	}
+
+	for i, step := range steps {
+		err := checker.Check(newFreshMacaroon(t, step.nonce), "app_1")
+		if err != step.err {
+			t.Fatalf("(%v) wrong error for nonce %v: %v, expected %v", i,
+				step.nonce, err, step.err)
+		}
+	}
+}
+
+func TestSwitchToSlidingWindowNonce(t *testing.T) {
+	state, err := useIncreasingNonce(nil, 10)
+	if err != nil {
+		t.Fatalf("unable to use nonce: %v", err)
+	}
+
+	// After the switch from increasing mode nonces below the mark should be
+	// considered used, because we don't know which of them were accepted.
+	if _, err := useWindowNonce(state, 9, 8); err != ErrNonceUsed {
+		t.Fatalf("nonce below the mark should be used: %v", err)
+	}
+
+	state, err = useWindowNonce(state, 12, 8)
+	if err != nil {
+		t.Fatalf("unable to use nonce: %v", err)
+	}
+
+	if _, err := useWindowNonce(state, 11, 8); err != nil {
+		t.Fatalf("nonce above the old mark should be accepted: %v", err)
+	}
+
+	if _, err := useWindowNonce(state, 10, 8); err != ErrNonceUsed {
+		t.Fatalf("old mark should be used: %v", err)
+	}
+}
+
+func TestClockSkewReplay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	checker := &NonceChecker{
+		DB:       db,
+		Lifetime: MacaroonLifetime,
+		Clock:    clock,
+		MaxSkew:  DefaultMaxClockSkew,
+	}
+
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AddNonce(m, 1)
+	if err != nil {
+		t.Fatalf("unable to add nonce: %v", err)
+	}
+
+	// Client clock is ahead within the tolerated skew, so that request
+	// remains fresh longer than the nonce lifetime.
+	clientClock := NewFakeClock(clock.Now().Add(DefaultMaxClockSkew))
+	m, err = AddCurrentTimeFrom(m, clientClock)
+	if err != nil {
+		t.Fatalf("unable to add current time: %v", err)
+	}
+
+	if err := checker.Check(m, "app_1"); err != nil {
+		t.Fatalf("macaroon should be accepted: %v", err)
+	}
+
+	db.StartFlushing()
+	defer db.StopFlushing()
+
+	clock.BlockUntil(1)
+	clock.Advance(MacaroonLifetime + time.Millisecond)
+	clock.BlockUntil(1)
+
+	// Nonce should be kept while request is fresh.
+	if err := checker.Check(m, "app_1"); err != ErrNonceUsed {
+		t.Fatalf("replayed macaroon should be rejected: %v", err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1540000000, 0))
+	skew := time.Second
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	checker := &NonceChecker{
+		DB:       db,
+		Lifetime: MacaroonLifetime,
+		Clock:    clock,
+		MaxSkew:  skew,
+	}
+
+	// newMacaroon emulates client which clock differs from ours.
+	newMacaroon := func(nonce int64,
+		clientOffset time.Duration) *macaroon.Macaroon {
+
+		m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+			macaroon.LatestVersion)
+		if err != nil {
+			t.Fatalf("unable to create macaron: %v", err)
+		}
+
+		m, err = AddNonce(m, nonce)
+		if err != nil {
+			t.Fatalf("unable to add nonce: %v", err)
+		}
+
+		clientClock := NewFakeClock(clock.Now().Add(clientOffset))
+		m, err = AddCurrentTimeFrom(m, clientClock)
+		if err != nil {
+			t.Fatalf("unable to add current time: %v", err)
+		}
+
+		return m
+	}
+
+	// Client clock is ahead within the tolerated skew.
+	if err := checker.Check(newMacaroon(1, skew), "app_1"); err != nil {
+		t.Fatalf("macaroon should be accepted: %v", err)
+	}
+
+	// Client clock is ahead more than the tolerated skew.
+	m := newMacaroon(2, skew+time.Nanosecond)
+	if err := checker.Check(m, "app_1"); err != ErrMacaroonFromFuture {
+		t.Fatalf("macaroon from future should be rejected: %v", err)
+	}
+
+	// Client clock is behind, skew is applied to the expiration as well.
+	m = newMacaroon(3, -MacaroonLifetime-skew)
+	if err := checker.Check(m, "app_1"); err != nil {
+		t.Fatalf("macaroon should be accepted: %v", err)
+	}
+
+	m = newMacaroon(4, -MacaroonLifetime-skew-time.Nanosecond)
+	if err := checker.Check(m, "app_1"); err != ErrMacaroonExpired {
+		t.Fatalf("macaroon should be expired: %v", err)
+	}
+}
@@ -1,13 +1,45 @@
 package auth
 
 import (
+	"path"
 	"strings"
+	"github.com/go-errors/errors"
 	"gopkg.in/macaroon.v2"
 )
 
-// DisableOperations restricts allowed operations.
+// Operation names are hierarchical, segments of the name are separated by
+// dots, e.g. "wallet.withdraw". Both allowed and disabled operations are
+// given as patterns which are matched against the operation name with the
+// following rules:
+//
+//  1. Pattern is split on segments by dots, every segment of the pattern is
+//     matched against the corresponding segment of the operation name with
+//     the glob syntax of path.Match, e.g. "*" matches any single segment and
+//     "with*" matches "withdraw".
+//  2. Pattern matches the operation itself and all operations below it in
+//     the hierarchy, e.g. "wallet" matches "wallet" and "wallet.withdraw",
+//     while "wallet.*" matches "wallet.withdraw" and "wallet.withdraw.btc"
+//     but not "wallet" itself.
+//  3. If macaroon has allowed operations, the operation should match at
+//     least one of them. After that if the operation matches any of disabled
+//     operations it is not allowed, disabled operations always take
+//     precedence over allowed ones regardless of how specific they are.
+//  4. Holder of the macaroon might add allowed and disabled operations
+//     several times. In this case operation should match every list of
+//     allowed operations and shouldn't match any list of disabled ones, i.e.
+//     allowed operations are intersected and disabled ones are united.
+//  5. Malformed pattern never matches in the allowed operations and always
+//     matches in the disabled operations, so that mistake in the pattern
+//     couldn't grant more rights.
+
+// DisableOperations restricts allowed operations. If macaroon already has
+// disabled operations, given operations are disabled in addition to them.
 func DisableOperations(m *macaroon.Macaroon, ops []string) (*macaroon.Macaroon,
 	error) {
+	if err := validateOperations(ops); err != nil {
+		return nil, err
+	}
+
 	newMac := m.Clone()
 	md, err := NewMacaroonDictionary(newMac)
 	if err != nil {
@@ -17,28 +49,125 @@ func DisableOperations(m *macaroon.Macaroon, ops []string) (*macaroon.Macaroon,
 	return newMac, md.Put(DisabledOperationPrefix, strings.Join(ops, ","))
 }
 
+// AllowOperations restricts the macaroon to the given operations only, all
+// other operations become not allowed. If macaroon already has allowed
+// operations, only operations allowed by both lists remain allowed.
+func AllowOperations(m *macaroon.Macaroon, ops []string) (*macaroon.Macaroon,
+	error) {
+	if err := validateOperations(ops); err != nil {
+		return nil, err
+	}
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(AllowedOperationPrefix, strings.Join(ops, ","))
+}
+
 // IsOperationAllowed checks that incoming macaroon has the ability to access the
-// desired method.
+// desired method. If macaroon has the list of allowed operations, operation
+// should match it, after that operation is checked against the list of
+// disabled operations.
 func IsOperationAllowed(m *macaroon.Macaroon, op string) bool {
 	md, err := NewMacaroonDictionary(m)
 	if err != nil {
 		return false
 	}
 
-	data, err := md.Get(DisabledOperationPrefix)
-	if err == ErrFieldNotFound {
-		// If disabled operation field not found all operations are allowed.
-		return true
-	} else if err != nil {
+	allowedLists, err := md.GetAll(AllowedOperationPrefix)
+	if err != nil && err != ErrFieldNotFound {
+		return false
+	}
+
+	for _, data := range allowedLists {
+		if !matchOperations(splitOperations(data), op, false) {
+			return false
+		}
+	}
+
+	// Operation is allowed unless it is disabled by any of the lists.
+	disabledLists, err := md.GetAll(DisabledOperationPrefix)
+	if err != nil && err != ErrFieldNotFound {
 		return false
 	}
 
-	disabledOperations := strings.Split(data, ",")
-	for _, disOp := range disabledOperations {
-		if op == disOp {
+	for _, data := range disabledLists {
+		if matchOperations(splitOperations(data), op, true) {
 			return false
 		}
 	}
 
 	return true
 }
+
+// splitOperations parses the list of operations stored in the caveat.
+func splitOperations(data string) []string {
+	if data == "" {
+		return nil
+	}
+
+	return strings.Split(data, ",")
+}
+
+// validateOperations checks that operation patterns are well-formed and
+// could be stored in the caveat.
+func validateOperations(ops []string) error {
+	for _, op := range ops {
+		if strings.Contains(op, ",") {
+			return errors.Errorf("operation %q contains comma", op)
+		}
+
+		if _, err := matchOperation(op, ""); err != nil {
+			return errors.Errorf("malformed operation pattern %q: %v", op,
+				err)
+		}
+	}
+
+	return nil
+}
+
+// matchOperations returns true if operation matches any of the patterns,
+// malformedMatch defines the result for malformed patterns.
+func matchOperations(patterns []string, op string, malformedMatch bool) bool {
+	for _, pattern := range patterns {
+		matched, err := matchOperation(pattern, op)
+		if err != nil {
+			matched = malformedMatch
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOperation returns true if operation matches the pattern, error is
+// returned only if pattern is malformed.
+func matchOperation(pattern, op string) (bool, error) {
+	patternSegments := strings.Split(pattern, ".")
+	opSegments := strings.Split(op, ".")
+
+	matched := len(patternSegments) <= len(opSegments)
+	for i, patternSegment := range patternSegments {
+		// Pattern is matched till the end even if result is already known,
+		// so that malformed pattern is always detected.
+		var opSegment string
+		if i < len(opSegments) {
+			opSegment = opSegments[i]
+		}
+
+		ok, err := path.Match(patternSegment, opSegment)
+		if err != nil {
+			return false, err
+		}
+
+		matched = matched && ok
+	}
+
+	return matched, nil
+}
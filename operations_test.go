@@ -30,3 +30,237 @@ func TestNotPermittedOperation(t *testing.T) {
 		t.Fatalf("expect operation to allowed")
 	}
 }
+
+func TestAllowedOperations(t *testing.T) {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AllowOperations(m, []string{"balance", "withdraw"})
+	if err != nil {
+		t.Fatalf("unable to allow operations: %v", err)
+	}
+
+	if !IsOperationAllowed(m, "balance") {
+		t.Fatalf("expect operation to be allowed")
+	}
+
+	if IsOperationAllowed(m, "new_operation") {
+		t.Fatalf("expect operation not in allowlist to be not allowed")
+	}
+
+	// Denylist is applied on top of the allowlist.
+	m, err = DisableOperations(m, []string{"withdraw"})
+	if err != nil {
+		t.Fatalf("unable to disable operations: %v", err)
+	}
+
+	if IsOperationAllowed(m, "withdraw") {
+		t.Fatalf("expect disabled operation to be not allowed")
+	}
+
+	if !IsOperationAllowed(m, "balance") {
+		t.Fatalf("expect operation to be allowed")
+	}
+}
+
+func TestEmptyAllowedOperations(t *testing.T) {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AllowOperations(m, nil)
+	if err != nil {
+		t.Fatalf("unable to allow operations: %v", err)
+	}
+
+	for _, op := range []string{"", "balance"} {
+		if IsOperationAllowed(m, op) {
+			t.Fatalf("expect operation %q to be not allowed", op)
+		}
+	}
+}
+
+func TestMatchOperation(t *testing.T) {
+	tests := []struct {
+		pattern string
+		op      string
+		matched bool
+	}{
+		{"wallet.withdraw", "wallet.withdraw", true},
+		{"wallet.withdraw", "wallet.balance", false},
+
+		// Pattern matches operations below it in the hierarchy.
+		{"wallet", "wallet", true},
+		{"wallet", "wallet.withdraw", true},
+		{"wallet", "wallets", false},
+		{"wallet.withdraw", "wallet", false},
+
+		// Wildcard matches single segment and everything below it.
+		{"wallet.*", "wallet", false},
+		{"wallet.*", "wallet.withdraw", true},
+		{"wallet.*", "wallet.withdraw.btc", true},
+		{"orders.read.*", "orders.read.history", true},
+		{"orders.read.*", "orders.create", false},
+		{"orders.*.create", "orders.spot.create", true},
+		{"orders.*.create", "orders.spot.cancel", false},
+		{"*", "orders", true},
+		{"*", "orders.create", true},
+
+		// Glob within the segment.
+		{"wallet.with*", "wallet.withdraw", true},
+		{"wallet.with*", "wallet.balance", false},
+		{"wallet.balanc?", "wallet.balance", true},
+	}
+
+	for _, test := range tests {
+		matched, err := matchOperation(test.pattern, test.op)
+		if err != nil {
+			t.Fatalf("unable to match %q: %v", test.pattern, err)
+		}
+
+		if matched != test.matched {
+			t.Fatalf("pattern %q, operation %q: matched %v, expected %v",
+				test.pattern, test.op, matched, test.matched)
+		}
+	}
+
+	if _, err := matchOperation("wallet.[", "wallet.withdraw"); err == nil {
+		t.Fatalf("expected error on malformed pattern")
+	}
+}
+
+func TestWildcardOperations(t *testing.T) {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	m, err = AllowOperations(m, []string{"wallet.*", "orders.read"})
+	if err != nil {
+		t.Fatalf("unable to allow operations: %v", err)
+	}
+
+	// Disabled operations take precedence even if they are less specific
+	// than allowed ones.
+	m, err = DisableOperations(m, []string{"wallet.with*"})
+	if err != nil {
+		t.Fatalf("unable to disable operations: %v", err)
+	}
+
+	tests := []struct {
+		op      string
+		allowed bool
+	}{
+		{"wallet.balance", true},
+		{"wallet.withdraw", false},
+		{"wallet.withdraw.btc", false},
+		{"wallet", false},
+		{"orders.read", true},
+		{"orders.read.history", true},
+		{"orders.create", false},
+	}
+
+	for _, test := range tests {
+		if IsOperationAllowed(m, test.op) != test.allowed {
+			t.Fatalf("operation %q: expected allowed %v", test.op,
+				test.allowed)
+		}
+	}
+
+	if _, err := DisableOperations(m, []string{"wallet.["}); err == nil {
+		t.Fatalf("malformed pattern shouldn't be accepted")
+	}
+
+	if _, err := AllowOperations(m, []string{"a,b"}); err == nil {
+		t.Fatalf("pattern with comma shouldn't be accepted")
+	}
+}
+
+func TestMalformedOperationPattern(t *testing.T) {
+	newMacaroon := func(key, value string) *macaroon.Macaroon {
+		m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+			macaroon.LatestVersion)
+		if err != nil {
+			t.Fatalf("unable to create macaron: %v", err)
+		}
+
+		// Emulate the client which puts the pattern directly, bypassing
+		// the validation.
+		md, err := NewMacaroonDictionary(m)
+		if err != nil {
+			t.Fatalf("unable to create macaron dictionary: %v", err)
+		}
+
+		if err := md.Put(key, value); err != nil {
+			t.Fatalf("unable to put field: %v", err)
+		}
+
+		return m
+	}
+
+	m := newMacaroon(AllowedOperationPrefix, "wallet.[")
+	if IsOperationAllowed(m, "wallet.withdraw") {
+		t.Fatalf("malformed allowed pattern shouldn't grant operation")
+	}
+
+	m = newMacaroon(DisabledOperationPrefix, "wallet.[")
+	if IsOperationAllowed(m, "wallet.withdraw") {
+		t.Fatalf("malformed disabled pattern should disable operation")
+	}
+}
+
+func TestAttenuatedOperations(t *testing.T) {
+	m, err := macaroon.New([]byte("kek"), nil, "bitlum",
+		macaroon.LatestVersion)
+	if err != nil {
+		t.Fatalf("unable to create macaron: %v", err)
+	}
+
+	// Emulate that server issued the token with operation restrictions.
+	m, err = AllowOperations(m, []string{"wallet", "orders"})
+	if err != nil {
+		t.Fatalf("unable to allow operations: %v", err)
+	}
+
+	m, err = DisableOperations(m, []string{"wallet.withdraw"})
+	if err != nil {
+		t.Fatalf("unable to disable operations: %v", err)
+	}
+
+	// Emulate that client narrows the token before passing it to the
+	// sub-component. Client tries to allow operation which hasn't been
+	// allowed by server, it should remain not allowed.
+	m, err = AllowOperations(m, []string{"wallet", "admin"})
+	if err != nil {
+		t.Fatalf("unable to allow operations: %v", err)
+	}
+
+	m, err = DisableOperations(m, []string{"wallet.deposit"})
+	if err != nil {
+		t.Fatalf("unable to disable operations: %v", err)
+	}
+
+	tests := []struct {
+		op      string
+		allowed bool
+	}{
+		{"wallet.balance", true},
+		{"wallet.withdraw", false},
+		{"wallet.deposit", false},
+		{"orders.create", false},
+		{"admin", false},
+	}
+
+	for _, test := range tests {
+		if IsOperationAllowed(m, test.op) != test.allowed {
+			t.Fatalf("operation %q: expected allowed %v", test.op,
+				test.allowed)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Package redisdb implements auth.DB on top of Redis. All replicas of the
+// service which use the same Redis share the used nonces, so that captured
+// token couldn't be replayed against every replica.
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/go-redis/redis/v8"
+)
+
+// DB is the Redis implementation of auth.DB.
+type DB struct {
+	client        *redis.Client
+	prefix        string
+	nonceLifetime time.Duration
+	clock         auth.Clock
+}
+
+// Runtime check to ensure that DB implements auth.DB.
+var _ auth.DB = (*DB)(nil)
+
+// New creates new database, all keys are prefixed with the given prefix so
+// that Redis could be shared with other services. Nonces are expired by
+// Redis itself after the nonce lifetime, or after the request expiration if
+// it is later. Expiration times are converted to Redis TTLs using the given
+// clock.
+func New(client *redis.Client, prefix string, nonceLifetime time.Duration,
+	clock auth.Clock) *DB {
+
+	return &DB{
+		client:        client,
+		prefix:        prefix,
+		nonceLifetime: nonceLifetime,
+		clock:         clock,
+	}
+}
+
+// Names of the keys, all of them are prefixed with the database prefix.
+const (
+	// rootKeysKey is the list of JSON encoded root keys, index of the key
+	// in the list is its id.
+	rootKeysKey = "root-keys"
+
+	// revokedTokensKey is the set of revoked token ids.
+	revokedTokensKey = "revoked-tokens"
+
+	// revokedUsersKey is the hash which maps user id on the user revocation
+	// time.
+	revokedUsersKey = "revoked-users"
+
+	// applicationsKey is the hash which maps application id on JSON
+	// encoded application.
+	applicationsKey = "applications"
+
+	// applicationSeqKey is the counter used to assign application ids.
+	applicationSeqKey = "applications-seq"
+)
+
+func (db *DB) key(name string) string {
+	return db.prefix + name
+}
+
+func (db *DB) nonceKey(principal string, nonce int64) string {
+	return db.key("nonce:" + principal + ":" + strconv.FormatInt(nonce, 10))
+}
+
+func (db *DB) nonceStateKey(principal string) string {
+	return db.key("nonce-state:" + principal)
+}
+
+func (db *DB) spendingKey(key string) string {
+	return db.key("spending:" + key)
+}
+
+func (db *DB) userApplicationsKey(userID auth.UserID) string {
+	return db.key("user-applications:" + string(userID))
+}
+
+func (db *DB) UseNonce(principal string, nonce int64,
+	expiresAt time.Time) (bool, error) {
+
+	// Nonce is kept at least for the nonce lifetime, and longer if request
+	// remains fresh after it.
+	ttl := expiresAt.Sub(db.clock.Now())
+	if ttl < db.nonceLifetime {
+		ttl = db.nonceLifetime
+	}
+
+	// SET NX is atomic, so that concurrent requests with the same nonce
+	// to different replicas couldn't both pass.
+	set, err := db.client.SetNX(context.Background(),
+		db.nonceKey(principal, nonce), db.clock.Now().UnixNano(),
+		ttl).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return !set, nil
+}
+
+func (db *DB) UpdateNonceState(principal string,
+	update func(state []byte) ([]byte, error)) error {
+
+	ctx := context.Background()
+	key := db.nonceStateKey(principal)
+
+	// State is replaced within optimistic transaction, if state has been
+	// changed concurrently we read it again and retry.
+	for {
+		err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+			state, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				state = nil
+			} else if err != nil {
+				return err
+			}
+
+			newState, err := update(state)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, newState, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+}
+
+func (db *DB) UpdateSpending(key string, expiresAt time.Time,
+	update func(spent uint64) (uint64, error)) error {
+
+	ctx := context.Background()
+	redisKey := db.spendingKey(key)
+
+	// Amount is replaced within optimistic transaction the same way as
+	// nonce state, record is expired by Redis itself.
+	for {
+		err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+			spent, err := tx.Get(ctx, redisKey).Uint64()
+			if err == redis.Nil {
+				spent = 0
+			} else if err != nil {
+				return err
+			}
+
+			newSpent, err := update(spent)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, redisKey, strconv.FormatUint(newSpent, 10), 0)
+				pipe.Expire(ctx, redisKey,
+					expiresAt.Sub(db.clock.Now()))
+				return nil
+			})
+			return err
+		}, redisKey)
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+}
+
+func (db *DB) GetRootKey() (*auth.RootKey, error) {
+	return db.getRootKey(-1)
+}
+
+func (db *DB) GetRootKeyByID(id uint32) (*auth.RootKey, error) {
+	return db.getRootKey(int64(id))
+}
+
+func (db *DB) getRootKey(index int64) (*auth.RootKey, error) {
+	data, err := db.client.LIndex(context.Background(), db.key(rootKeysKey),
+		index).Bytes()
+	if err == redis.Nil {
+		return nil, auth.ErrRootKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	key := &auth.RootKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (db *DB) PutRootKey(rootKey []byte) error {
+	ctx := context.Background()
+	listKey := db.key(rootKeysKey)
+
+	// Retirement of the previous key and addition of the new one should be
+	// atomic, otherwise concurrent rotations could assign the same id. If
+	// keys have been changed concurrently we read them again and retry.
+	for {
+		err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+			now := db.clock.Now()
+
+			// First key gets id 0, which makes tokens issued in legacy
+			// format verifiable, every next key gets id of previous plus
+			// one.
+			var lastKey *auth.RootKey
+			data, err := tx.LIndex(ctx, listKey, -1).Bytes()
+			switch {
+			case err == nil:
+				lastKey = &auth.RootKey{}
+				if err := json.Unmarshal(data, lastKey); err != nil {
+					return err
+				}
+				lastKey.RetiredAt = now
+
+			case err != redis.Nil:
+				return err
+			}
+
+			newKey := &auth.RootKey{
+				Key:       rootKey,
+				CreatedAt: now,
+			}
+			if lastKey != nil {
+				newKey.ID = lastKey.ID + 1
+			}
+
+			newData, err := json.Marshal(newKey)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if lastKey != nil {
+					lastData, err := json.Marshal(lastKey)
+					if err != nil {
+						return err
+					}
+
+					pipe.LSet(ctx, listKey, -1, lastData)
+				}
+
+				pipe.RPush(ctx, listKey, newData)
+				return nil
+			})
+			return err
+		}, listKey)
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+}
+
+func (db *DB) RevokeToken(tokenID string) error {
+	return db.client.SAdd(context.Background(), db.key(revokedTokensKey),
+		tokenID).Err()
+}
+
+func (db *DB) IsTokenRevoked(tokenID string) (bool, error) {
+	return db.client.SIsMember(context.Background(),
+		db.key(revokedTokensKey), tokenID).Result()
+}
+
+func (db *DB) RevokeUserTokens(userID auth.UserID, before time.Time) error {
+	ctx := context.Background()
+	hashKey := db.key(revokedUsersKey)
+	field := string(userID)
+
+	// Revocation time is replaced within optimistic transaction, if it
+	// has been changed concurrently we read it again and retry.
+	for {
+		err := db.client.Watch(ctx, func(tx *redis.Tx) error {
+			// Revocation time could only be moved forward, otherwise
+			// already revoked tokens would become valid again.
+			current, err := tx.HGet(ctx, hashKey, field).Int64()
+			switch {
+			case err == nil:
+				if !before.After(time.Unix(0, current)) {
+					return nil
+				}
+
+			case err != redis.Nil:
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, hashKey, field, before.UnixNano())
+				return nil
+			})
+			return err
+		}, hashKey)
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+}
+
+func (db *DB) GetUserRevocationTime(userID auth.UserID) (time.Time, error) {
+	before, err := db.client.HGet(context.Background(),
+		db.key(revokedUsersKey), string(userID)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, before), nil
+}
+
+func (db *DB) PutApplication(app *auth.Application) error {
+	ctx := context.Background()
+
+	// Counter starts from one, zero id is reserved for tokens which are not
+	// bound to the application.
+	id, err := db.client.Incr(ctx, db.key(applicationSeqKey)).Result()
+	if err != nil {
+		return err
+	}
+
+	storedApp := *app
+	storedApp.ID = uint32(id)
+
+	data, err := json.Marshal(&storedApp)
+	if err != nil {
+		return err
+	}
+
+	field := strconv.FormatUint(uint64(storedApp.ID), 10)
+	_, err = db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, db.key(applicationsKey), field, data)
+		pipe.SAdd(ctx, db.userApplicationsKey(app.UserID), field)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	app.ID = storedApp.ID
+	return nil
+}
+
+func (db *DB) GetApplication(id uint32) (*auth.Application, error) {
+	data, err := db.client.HGet(context.Background(),
+		db.key(applicationsKey), strconv.FormatUint(uint64(id), 10)).Bytes()
+	if err == redis.Nil {
+		return nil, auth.ErrApplicationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	app := &auth.Application{}
+	if err := json.Unmarshal(data, app); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func (db *DB) GetUserApplications(userID auth.UserID) ([]*auth.Application,
+	error) {
+
+	ctx := context.Background()
+	ids, err := db.client.SMembers(ctx, db.userApplicationsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	values, err := db.client.HMGet(ctx, db.key(applicationsKey),
+		ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]*auth.Application, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		app := &auth.Application{}
+		if err := json.Unmarshal([]byte(data), app); err != nil {
+			return nil, err
+		}
+
+		apps = append(apps, app)
+	}
+
+	return apps, nil
+}
@@ -0,0 +1,133 @@
+package redisdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/bitlum/macaroon-application-auth/internal/dbtest"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestDB creates database on top of in-process Redis, returned cleanup
+// function stops the server.
+func newTestDB(t *testing.T, nonceLifetime time.Duration,
+	clock auth.Clock) (*DB, *miniredis.Miniredis, func()) {
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start redis: %v", err)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+
+	cleanup := func() {
+		client.Close()
+		server.Close()
+	}
+
+	return New(client, "auth:", nonceLifetime, clock), server, cleanup
+}
+
+func TestDB(t *testing.T) {
+	dbtest.TestDB(t, func(t *testing.T) (auth.DB, func()) {
+		db, _, cleanup := newTestDB(t, auth.MacaroonLifetime,
+			auth.SystemClock)
+		return db, cleanup
+	})
+}
+
+func TestNonceExpiration(t *testing.T) {
+	// Clock of the service isn't required to match the one of Redis, so
+	// that expiration is given to Redis relative to the service clock.
+	clock := auth.NewFakeClock(time.Unix(1540000000, 0))
+	db, server, cleanup := newTestDB(t, auth.MacaroonLifetime, clock)
+	defer cleanup()
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || !used {
+		t.Fatalf("nonce should be used: %v", err)
+	}
+
+	// Nonce of the request which remains fresh longer than nonce lifetime
+	// should be kept until request expiration.
+	expiresAt := clock.Now().Add(2 * auth.MacaroonLifetime)
+	if used, err := db.UseNonce("app_1", 11, expiresAt); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	// After nonce lifetime Redis should remove the nonce.
+	clock.Advance(auth.MacaroonLifetime)
+	server.FastForward(auth.MacaroonLifetime)
+
+	if used, err := db.UseNonce("app_1", 10, clock.Now()); err != nil || used {
+		t.Fatalf("nonce should be expired: %v", err)
+	}
+
+	if used, err := db.UseNonce("app_1", 11, expiresAt); err != nil || !used {
+		t.Fatalf("nonce should be kept: %v", err)
+	}
+}
+
+func TestSharedNonces(t *testing.T) {
+	db, server, cleanup := newTestDB(t, auth.MacaroonLifetime,
+		auth.SystemClock)
+	defer cleanup()
+
+	// Emulate another replica of the service which uses the same Redis.
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	defer client.Close()
+	replicaDB := New(client, "auth:", auth.MacaroonLifetime,
+		auth.SystemClock)
+
+	if used, err := db.UseNonce("app_1", 10, time.Now()); err != nil || used {
+		t.Fatalf("nonce shouldn't be used: %v", err)
+	}
+
+	if used, err := replicaDB.UseNonce("app_1", 10, time.Now()); err != nil || !used {
+		t.Fatalf("nonce should be used on replica: %v", err)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	db, _, cleanup := newTestDB(t, auth.MacaroonLifetime,
+		auth.SystemClock)
+	defer cleanup()
+
+	// Concurrent writes to the same watched key shouldn't fail, but should
+	// be retried.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := db.PutRootKey([]byte("kek")); err != nil {
+				t.Errorf("unable to put root key: %v", err)
+			}
+
+			if err := db.RevokeUserTokens("1", time.Now()); err != nil {
+				t.Errorf("unable to revoke user tokens: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	key, err := db.GetRootKey()
+	if err != nil {
+		t.Fatalf("unable to get root key: %v", err)
+	}
+
+	if key.ID != 9 {
+		t.Fatalf("wrong root key id: %v", key.ID)
+	}
+}
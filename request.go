@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon.v2"
+)
+
+// requestBinding is the request to which macaroon is bound, it is encoded
+// in the caveat as the method, path and hex encoded SHA-256 of the body
+// separated by spaces.
+type requestBinding struct {
+	method   string
+	path     string
+	bodyHash string
+}
+
+func newRequestBinding(method, path string, body []byte) *requestBinding {
+	hash := sha256.Sum256(body)
+	return &requestBinding{
+		method:   strings.ToUpper(method),
+		path:     path,
+		bodyHash: hex.EncodeToString(hash[:]),
+	}
+}
+
+func (r *requestBinding) encode() string {
+	return r.method + " " + r.path + " " + r.bodyHash
+}
+
+func decodeRequestBinding(value string) (*requestBinding, error) {
+	parts := strings.Split(value, " ")
+	if len(parts) != 3 {
+		return nil, errors.Errorf("malformed request binding: %q", value)
+	}
+
+	return &requestBinding{
+		method:   parts[0],
+		path:     parts[1],
+		bodyHash: parts[2],
+	}, nil
+}
+
+func checkRequestCaveat(value string) error {
+	_, err := decodeRequestBinding(value)
+	return err
+}
+
+// BindRequest is used by the client application to bind the macaroon to the
+// particular request before making it, together with the nonce and time.
+// With this macaroon intercepted before its nonce has been used couldn't be
+// used for the different request. Path should be given in the same form as
+// the server sees it, e.g. http.Request.URL.RequestURI.
+func BindRequest(m *macaroon.Macaroon, method, path string,
+	body []byte) (*macaroon.Macaroon, error) {
+
+	if strings.ContainsAny(method+path, " ") {
+		return nil, errors.Errorf("method and path shouldn't contain spaces")
+	}
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	binding := newRequestBinding(method, path, body)
+	return newMac, md.Put(RequestPrefix, binding.encode())
+}
+
+type requestKey struct{}
+
+// ContextWithRequest returns the context which describes the request being
+// authenticated, so that request bound to the macaroon could be verified.
+func ContextWithRequest(ctx context.Context, method, path string,
+	body []byte) context.Context {
+
+	return context.WithValue(ctx, requestKey{},
+		newRequestBinding(method, path, body))
+}
+
+// checkRequestBinding checks that macaroon is used for the request to which
+// it has been bound. If binding is required, macaroon without it is rejected.
+func checkRequestBinding(ctx context.Context, m *macaroon.Macaroon,
+	required bool) error {
+
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		return err
+	}
+
+	value, err := md.Get(RequestPrefix)
+	if err == ErrFieldNotFound {
+		if required {
+			return ErrRequestMismatch
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	binding, err := decodeRequestBinding(value)
+	if err != nil {
+		return err
+	}
+
+	request, ok := ctx.Value(requestKey{}).(*requestBinding)
+	if !ok || *request != *binding {
+		return ErrRequestMismatch
+	}
+
+	return nil
+}
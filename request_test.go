@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestBinding(t *testing.T) {
+	db := NewInMemoryDB([]byte("kek"), MacaroonLifetime)
+	auth, err := NewAuth("", db)
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	body := []byte(`{"amount": 100}`)
+	bind := func(nonce int64, method, path string, body []byte) string {
+		m, err := DecodeMacaroon(addFreshness(t, tokenStr, nonce))
+		if err != nil {
+			t.Fatalf("unable to decode macaroon: %v", err)
+		}
+
+		m, err = BindRequest(m, method, path, body)
+		if err != nil {
+			t.Fatalf("unable to bind request: %v", err)
+		}
+
+		boundStr, err := EncodeMacaroon(m)
+		if err != nil {
+			t.Fatalf("unable to encode macaroon: %v", err)
+		}
+
+		return boundStr
+	}
+
+	ctx := ContextWithRequest(context.Background(), "POST", "/withdraw", body)
+
+	steps := []struct {
+		tokenStr string
+		ctx      context.Context
+		err      error
+	}{
+		{bind(1, "post", "/withdraw", body), ctx, nil},
+		{bind(2, "GET", "/withdraw", body), ctx, ErrRequestMismatch},
+		{bind(3, "POST", "/deposit", body), ctx, ErrRequestMismatch},
+		{bind(4, "POST", "/withdraw", nil), ctx, ErrRequestMismatch},
+
+		// Bound token requires the request to be known.
+		{bind(5, "POST", "/withdraw", body), context.Background(),
+			ErrRequestMismatch},
+
+		// Binding is optional by default.
+		{addFreshness(t, tokenStr, 6), ctx, nil},
+	}
+
+	for i, step := range steps {
+		_, err := auth.ExtractTokenContext(step.ctx, step.tokenStr)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error: %v, expected %v", i, err, step.err)
+		}
+	}
+
+	strictAuth, err := NewAuth("", db, RequireRequestBinding())
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	_, err = strictAuth.ExtractTokenContext(ctx, addFreshness(t, tokenStr, 7))
+	if err != ErrRequestMismatch {
+		t.Fatalf("unbound token should be rejected: %v", err)
+	}
+
+	_, err = strictAuth.ExtractTokenContext(ctx, bind(8, "POST", "/withdraw",
+		body))
+	if err != nil {
+		t.Fatalf("bound token should be accepted: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"strings"
+
+	"gopkg.in/macaroon.v2"
+)
+
+// Resources are the objects on which operations are made, e.g. sub-account
+// or wallet. Resource names are hierarchical and are matched against the
+// allowed resource patterns with the same rules as operations, e.g. pattern
+// "account.42" matches resources "account.42" and "account.42.wallet.btc".
+// If macaroon has allowed resources several times, resource should match
+// every list of them.
+
+// AllowResources restricts the macaroon to the given resources only. If
+// macaroon already has allowed resources, only resources allowed by both
+// lists remain allowed.
+func AllowResources(m *macaroon.Macaroon, resources []string) (
+	*macaroon.Macaroon, error) {
+
+	if err := validateOperations(resources); err != nil {
+		return nil, err
+	}
+
+	newMac := m.Clone()
+	md, err := NewMacaroonDictionary(newMac)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, md.Put(AllowedResourcePrefix, strings.Join(resources, ","))
+}
+
+// IsResourceAllowed checks that incoming macaroon has the ability to access
+// the given resource. Empty resource is allowed only if macaroon is not
+// restricted to any resources.
+func IsResourceAllowed(m *macaroon.Macaroon, resource string) bool {
+	md, err := NewMacaroonDictionary(m)
+	if err != nil {
+		return false
+	}
+
+	allowedLists, err := md.GetAll(AllowedResourcePrefix)
+	if err != nil && err != ErrFieldNotFound {
+		return false
+	}
+
+	for _, data := range allowedLists {
+		if resource == "" {
+			return false
+		}
+
+		if !matchOperations(splitOperations(data), resource, false) {
+			return false
+		}
+	}
+
+	return true
+}
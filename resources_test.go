@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestResourceScopedToken(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		AllowedResources([]string{"account.42", "account.43"}))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Client narrows the token down to the single sub-account before
+	// passing it to the bot.
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	m, err = AllowResources(m, []string{"account.42"})
+	if err != nil {
+		t.Fatalf("unable to allow resources: %v", err)
+	}
+
+	narrowedStr, err := EncodeMacaroon(m)
+	if err != nil {
+		t.Fatalf("unable to encode macaroon: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, narrowedStr, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	steps := []struct {
+		resource string
+		err      error
+	}{
+		{"account.42", nil},
+		{"account.42.wallet.btc", nil},
+		{"account.43", ErrResourceNotAllowed},
+		{"account", ErrResourceNotAllowed},
+		{"", ErrResourceNotAllowed},
+	}
+
+	for i, step := range steps {
+		err := token.IsAuthorizedFor("trade", step.resource)
+		if err != step.err {
+			t.Fatalf("(%v) wrong error for resource %v: %v, expected %v",
+				i, step.resource, err, step.err)
+		}
+	}
+
+	if err := token.IsAuthorized("trade"); err != ErrResourceNotAllowed {
+		t.Fatalf("operation without resource should be not allowed: %v",
+			err)
+	}
+
+	// Token without resource restriction is authorized for any resource.
+	tokenStr, err = auth.GenerateToken("100", appID, []string{"withdraw"})
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	token, err = auth.ExtractToken(addFreshness(t, tokenStr, 2))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if err := token.IsAuthorizedFor("trade", "account.1"); err != nil {
+		t.Fatalf("operation should be allowed: %v", err)
+	}
+
+	err = token.IsAuthorizedFor("withdraw", "account.1")
+	if err != ErrOperNotAllowed {
+		t.Fatalf("operation should be not allowed: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// newTokenID generates random unique token id.
+func newTokenID() ([]byte, error) {
+	tokenID := make([]byte, tokenIDSize)
+	if _, err := rand.Read(tokenID); err != nil {
+		return nil, err
+	}
+
+	return tokenID, nil
+}
+
+// GetTokenID returns the id of the given token, without validation of the
+// token itself. It is used by the issuer to store the id of generated token,
+// so that later the token could be revoked.
+func GetTokenID(tokenStr string) (string, error) {
+	ms, err := DecodeMacaroons(tokenStr)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := decodeIdentifier(ms[0].Id())
+	if err != nil {
+		return "", err
+	}
+
+	return id.tokenIDString(), nil
+}
+
+// RevokeToken revokes the token with the given id, after that the token, all
+// tokens derived from it by the client and all child tokens issued with it
+// are rejected.
+func (a *Auth) RevokeToken(tokenID string) error {
+	return a.db.RevokeToken(tokenID)
+}
+
+// RevokeAllForUser revokes all tokens of the user issued up to this moment,
+// including legacy tokens which do not have the token id.
+func (a *Auth) RevokeAllForUser(userID UserID) error {
+	return a.db.RevokeUserTokens(userID, a.clock.Now())
+}
+
+// checkRevocation returns ErrTokenRevoked if token with the given identifier
+// has been revoked either by its id, or by id of any token from which it has
+// been issued, or as one of the user tokens.
+func (a *Auth) checkRevocation(id *identifier) error {
+	var tokenIDs [][]byte
+	if id.tokenID != nil {
+		tokenIDs = append(tokenIDs, id.tokenID)
+	}
+	tokenIDs = append(tokenIDs, id.lineage...)
+
+	for _, tokenID := range tokenIDs {
+		revoked, err := a.db.IsTokenRevoked(hex.EncodeToString(tokenID))
+		if err != nil {
+			return err
+		}
+
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+
+	// Legacy tokens do not have the issue time, so they are revoked with
+	// any user revocation. Token issued at the moment of revocation is
+	// revoked as well.
+	revocationTime, err := a.db.GetUserRevocationTime(id.userID)
+	if err != nil {
+		return err
+	}
+
+	if !revocationTime.IsZero() && !id.issuedAt.After(revocationTime) {
+		return ErrTokenRevoked
+	}
+
+	return nil
+}
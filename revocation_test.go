@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokeToken(t *testing.T) {
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	revokedToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	validToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	tokenID, err := GetTokenID(revokedToken)
+	if err != nil {
+		t.Fatalf("unable to get token id: %v", err)
+	}
+
+	token, err := auth.ExtractToken(addFreshness(t, revokedToken, 1))
+	if err != nil {
+		t.Fatalf("unable to extract token: %v", err)
+	}
+
+	if token.ID() != tokenID {
+		t.Fatalf("wrong token id: %v, expected %v", token.ID(), tokenID)
+	}
+
+	if err := auth.RevokeToken(tokenID); err != nil {
+		t.Fatalf("unable to revoke token: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, revokedToken, 2))
+	if err != ErrTokenRevoked {
+		t.Fatalf("revoked token should be rejected: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(addFreshness(t, validToken, 3)); err != nil {
+		t.Fatalf("token should be accepted: %v", err)
+	}
+}
+
+func TestRevokeAllForUser(t *testing.T) {
+	// Clock is frozen, so that tokens are issued at the same moment when
+	// they are revoked.
+	clock := NewFakeClock(time.Now())
+	auth, err := NewAuth("", NewInMemoryDB([]byte("kek"), MacaroonLifetime),
+		TimeSource(clock))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	otherAppID := registerApplication(t, auth, "200")
+
+	userToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	otherUserToken, err := auth.GenerateToken("200", otherAppID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	if err := auth.RevokeAllForUser("100"); err != nil {
+		t.Fatalf("unable to revoke user tokens: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, userToken, 1))
+	if err != ErrTokenRevoked {
+		t.Fatalf("revoked token should be rejected: %v", err)
+	}
+
+	_, err = auth.ExtractToken(addFreshness(t, otherUserToken, 2))
+	if err != nil {
+		t.Fatalf("token should be accepted: %v", err)
+	}
+
+	// Tokens issued after the revocation should be accepted.
+	clock.Advance(time.Nanosecond)
+	newToken, err := auth.GenerateToken("100", appID, nil)
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(addFreshness(t, newToken, 3)); err != nil {
+		t.Fatalf("token should be accepted: %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+// Package sqldb implements the persistent auth.DB on top of database/sql,
+// which allows to keep the auth state next to the rest of service data.
+// Supported dialects are SQLite and PostgreSQL, the driver itself should be
+// imported by the user of the package.
+package sqldb
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/go-errors/errors"
+)
+
+// DB is the database/sql implementation of auth.DB.
+type DB struct {
+	db            *sql.DB
+	dialect       *Dialect
+	nonceLifetime time.Duration
+	clock         auth.Clock
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+// Runtime check to ensure that DB implements auth.DB.
+var _ auth.DB = (*DB)(nil)
+
+// New creates new database and applies schema migrations which haven't been
+// applied yet. Nonces are kept in the database at least for the nonce
+// lifetime, and until the request expiration if it is later. Nonce lifetime
+// is also the period of background compaction, which is timed by the given
+// clock.
+func New(db *sql.DB, dialect *Dialect, nonceLifetime time.Duration,
+	clock auth.Clock) (*DB, error) {
+
+	sqlDB := &DB{
+		db:            db,
+		dialect:       dialect,
+		nonceLifetime: nonceLifetime,
+		clock:         clock,
+		quit:          make(chan struct{}),
+	}
+
+	if err := sqlDB.migrate(); err != nil {
+		return nil, err
+	}
+
+	return sqlDB, nil
+}
+
+// migrate applies migrations which haven't been applied yet, schema version
+// is stored in the separate table.
+func (db *DB) migrate() error {
+	return db.withTx(func(tx *sql.Tx) error {
+		// Replicas of the service might be started concurrently, so that
+		// schema is read and migrated under the lock.
+		if db.dialect.migrationLock != "" {
+			if _, err := tx.Exec(db.dialect.migrationLock); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL
+		)`)
+		if err != nil {
+			return err
+		}
+
+		var version int
+		err = tx.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (0)`)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+
+		if version > len(db.dialect.migrations) {
+			return errors.Errorf("unknown schema version: %v", version)
+		}
+
+		for _, migration := range db.dialect.migrations[version:] {
+			if _, err := tx.Exec(migration); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(db.dialect.rebind(
+			`UPDATE schema_version SET version = ?`),
+			len(db.dialect.migrations))
+		return err
+	})
+}
+
+// withTx executes the given function within the transaction, which is
+// committed if function succeeded and rolled back otherwise.
+func (db *DB) withTx(f func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.db.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return db.db.QueryRow(db.dialect.rebind(query), args...)
+}
+
+// StartFlushing starts background compaction which periodically removes
+// expired nonces and spendings from the database.
+func (db *DB) StartFlushing() {
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+
+		for {
+			select {
+			case <-db.clock.After(db.nonceLifetime):
+			case <-db.quit:
+				return
+			}
+
+			// Error is ignored because the next iteration will try
+			// to remove the same records again.
+			db.FlushNonces()
+			db.FlushSpendings()
+		}
+	}()
+}
+
+// StopFlushing stops background compaction of nonces.
+func (db *DB) StopFlushing() {
+	close(db.quit)
+	db.wg.Wait()
+}
+
+// FlushNonces removes nonces which are kept longer than required.
+func (db *DB) FlushNonces() error {
+	_, err := db.exec(`DELETE FROM nonces WHERE keep_until < ?`,
+		db.clock.Now().UnixNano())
+	return err
+}
+
+// FlushSpendings removes spendings which quota period has ended.
+func (db *DB) FlushSpendings() error {
+	_, err := db.exec(`DELETE FROM spendings WHERE expires_at < ?`,
+		db.clock.Now().UnixNano())
+	return err
+}
+
+func (db *DB) UseNonce(principal string, nonce int64,
+	expiresAt time.Time) (bool, error) {
+
+	// Nonce is kept at least for the nonce lifetime, and longer if request
+	// remains fresh after it.
+	keepUntil := db.clock.Now().Add(db.nonceLifetime)
+	if expiresAt.After(keepUntil) {
+		keepUntil = expiresAt
+	}
+
+	// Insertion either succeeds or is ignored atomically, so that
+	// concurrent requests with the same nonce couldn't both pass.
+	res, err := db.exec(`
+		INSERT INTO nonces (principal, nonce, keep_until) VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		principal, nonce, keepUntil.UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return inserted == 0, nil
+}
+
+func (db *DB) UpdateNonceState(principal string,
+	update func(state []byte) ([]byte, error)) error {
+
+	// State is replaced with compare-and-swap, which works the same way in
+	// all dialects. If state has been changed concurrently we read it again
+	// and retry.
+	for {
+		var state []byte
+		err := db.queryRow(`
+			SELECT state FROM nonce_states WHERE principal = ?`,
+			principal).Scan(&state)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		exists := err == nil
+
+		newState, err := update(state)
+		if err != nil {
+			return err
+		}
+
+		var res sql.Result
+		if exists {
+			res, err = db.exec(`
+				UPDATE nonce_states SET state = ?
+				WHERE principal = ? AND state = ?`,
+				newState, principal, state)
+		} else {
+			res, err = db.exec(`
+				INSERT INTO nonce_states (principal, state) VALUES (?, ?)
+				ON CONFLICT DO NOTHING`,
+				principal, newState)
+		}
+		if err != nil {
+			return err
+		}
+
+		swapped, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if swapped != 0 {
+			return nil
+		}
+	}
+}
+
+func (db *DB) UpdateSpending(key string, expiresAt time.Time,
+	update func(spent uint64) (uint64, error)) error {
+
+	// Amount is replaced with compare-and-swap the same way as nonce state,
+	// unsigned amount is stored as the signed integer of the same bits.
+	for {
+		var spent int64
+		err := db.queryRow(`
+			SELECT spent FROM spendings WHERE key = ?`,
+			key).Scan(&spent)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		exists := err == nil
+
+		newSpent, err := update(uint64(spent))
+		if err != nil {
+			return err
+		}
+
+		var res sql.Result
+		if exists {
+			res, err = db.exec(`
+				UPDATE spendings SET spent = ?, expires_at = ?
+				WHERE key = ? AND spent = ?`,
+				int64(newSpent), expiresAt.UnixNano(), key, spent)
+		} else {
+			res, err = db.exec(`
+				INSERT INTO spendings (key, spent, expires_at)
+				VALUES (?, ?, ?)
+				ON CONFLICT DO NOTHING`,
+				key, int64(newSpent), expiresAt.UnixNano())
+		}
+		if err != nil {
+			return err
+		}
+
+		swapped, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if swapped != 0 {
+			return nil
+		}
+	}
+}
+
+func (db *DB) GetRootKey() (*auth.RootKey, error) {
+	return db.getRootKey(`
+		SELECT id, key, created_at, retired_at FROM root_keys
+		ORDER BY id DESC LIMIT 1`)
+}
+
+func (db *DB) GetRootKeyByID(id uint32) (*auth.RootKey, error) {
+	return db.getRootKey(`
+		SELECT id, key, created_at, retired_at FROM root_keys
+		WHERE id = ?`, int64(id))
+}
+
+func (db *DB) getRootKey(query string, args ...interface{}) (*auth.RootKey,
+	error) {
+
+	var (
+		id                   int64
+		createdAt, retiredAt int64
+		key                  = &auth.RootKey{}
+	)
+
+	err := db.queryRow(query, args...).Scan(&id, &key.Key, &createdAt,
+		&retiredAt)
+	if err == sql.ErrNoRows {
+		return nil, auth.ErrRootKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	key.ID = uint32(id)
+	key.CreatedAt = time.Unix(0, createdAt)
+	key.RetiredAt = decodeTime(retiredAt)
+	return key, nil
+}
+
+func (db *DB) PutRootKey(rootKey []byte) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		now := db.clock.Now().UnixNano()
+
+		// First key gets id 0, which makes tokens issued in legacy format
+		// verifiable, every next key gets id of previous plus one.
+		var lastID sql.NullInt64
+		err := tx.QueryRow(`SELECT MAX(id) FROM root_keys`).Scan(&lastID)
+		if err != nil {
+			return err
+		}
+
+		var id int64
+		if lastID.Valid {
+			_, err := tx.Exec(db.dialect.rebind(`
+				UPDATE root_keys SET retired_at = ? WHERE id = ?`),
+				now, lastID.Int64)
+			if err != nil {
+				return err
+			}
+
+			id = lastID.Int64 + 1
+		}
+
+		_, err = tx.Exec(db.dialect.rebind(`
+			INSERT INTO root_keys (id, key, created_at) VALUES (?, ?, ?)`),
+			id, rootKey, now)
+		return err
+	})
+}
+
+func (db *DB) RevokeToken(tokenID string) error {
+	_, err := db.exec(`
+		INSERT INTO revoked_tokens (token_id) VALUES (?)
+		ON CONFLICT DO NOTHING`, tokenID)
+	return err
+}
+
+func (db *DB) IsTokenRevoked(tokenID string) (bool, error) {
+	var count int
+	err := db.queryRow(`
+		SELECT COUNT(*) FROM revoked_tokens WHERE token_id = ?`,
+		tokenID).Scan(&count)
+	return count != 0, err
+}
+
+func (db *DB) RevokeUserTokens(userID auth.UserID, before time.Time) error {
+	// Revocation time could only be moved forward, otherwise already
+	// revoked tokens would become valid again.
+	_, err := db.exec(`
+		INSERT INTO revoked_users (user_id, revoked_before) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE
+		SET revoked_before = excluded.revoked_before
+		WHERE revoked_users.revoked_before < excluded.revoked_before`,
+		string(userID), before.UnixNano())
+	return err
+}
+
+func (db *DB) GetUserRevocationTime(userID auth.UserID) (time.Time, error) {
+	var before int64
+	err := db.queryRow(`
+		SELECT revoked_before FROM revoked_users WHERE user_id = ?`,
+		string(userID)).Scan(&before)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, before), nil
+}
+
+func (db *DB) PutApplication(app *auth.Application) error {
+	query := `
+		INSERT INTO applications (name, user_id, created_at, description)
+		VALUES (?, ?, ?, ?)`
+	args := []interface{}{app.Name, string(app.UserID),
+		app.CreatedAt.UnixNano(), app.Description}
+
+	// PostgreSQL driver doesn't support LastInsertId, and RETURNING isn't
+	// supported by SQLite older than 3.35.
+	var id int64
+	if db.dialect.returningID {
+		err := db.queryRow(query+` RETURNING id`, args...).Scan(&id)
+		if err != nil {
+			return err
+		}
+	} else {
+		res, err := db.exec(query, args...)
+		if err != nil {
+			return err
+		}
+
+		id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+	}
+
+	app.ID = uint32(id)
+	return nil
+}
+
+func (db *DB) GetApplication(id uint32) (*auth.Application, error) {
+	rows, err := db.db.Query(db.dialect.rebind(`
+		SELECT id, name, user_id, created_at, description FROM applications
+		WHERE id = ?`), int64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	apps, err := scanApplications(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apps) == 0 {
+		return nil, auth.ErrApplicationNotFound
+	}
+
+	return apps[0], nil
+}
+
+func (db *DB) GetUserApplications(userID auth.UserID) ([]*auth.Application,
+	error) {
+
+	rows, err := db.db.Query(db.dialect.rebind(`
+		SELECT id, name, user_id, created_at, description FROM applications
+		WHERE user_id = ? ORDER BY id`), string(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanApplications(rows)
+}
+
+func scanApplications(rows *sql.Rows) ([]*auth.Application, error) {
+	defer rows.Close()
+
+	var apps []*auth.Application
+	for rows.Next() {
+		var (
+			id, createdAt int64
+			userID        string
+			app           = &auth.Application{}
+		)
+
+		err := rows.Scan(&id, &app.Name, &userID, &createdAt,
+			&app.Description)
+		if err != nil {
+			return nil, err
+		}
+
+		app.ID = uint32(id)
+		app.UserID = auth.UserID(userID)
+		app.CreatedAt = time.Unix(0, createdAt)
+		apps = append(apps, app)
+	}
+
+	return apps, rows.Err()
+}
+
+// decodeTime converts stored unix nano time, where zero means unset time.
+func decodeTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, t)
+}
@@ -0,0 +1,189 @@
+package sqldb
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitlum/macaroon-application-auth"
+	"github.com/bitlum/macaroon-application-auth/internal/dbtest"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newSQLiteDB creates database in the temporary directory, returned cleanup
+// function closes database and removes the directory.
+func newSQLiteDB(t *testing.T) (*DB, func()) {
+	dir, err := ioutil.TempDir("", "sqldb")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(dir, "auth.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to open db: %v", err)
+	}
+
+	cleanup := func() {
+		sqlDB.Close()
+		os.RemoveAll(dir)
+	}
+
+	db, err := New(sqlDB, SQLite, auth.MacaroonLifetime,
+		auth.SystemClock)
+	if err != nil {
+		cleanup()
+		t.Fatalf("unable to create db: %v", err)
+	}
+
+	return db, cleanup
+}
+
+func TestSQLite(t *testing.T) {
+	dbtest.TestDB(t, func(t *testing.T) (auth.DB, func()) {
+		return newSQLiteDB(t)
+	})
+}
+
+// TestPostgreSQL runs the suite against the PostgreSQL database given by the
+// connection string in SQLDB_POSTGRES_DSN environment variable. Database
+// should be empty, because tables are dropped after every test case.
+func TestPostgreSQL(t *testing.T) {
+	dsn := os.Getenv("SQLDB_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SQLDB_POSTGRES_DSN isn't set")
+	}
+
+	dbtest.TestDB(t, func(t *testing.T) (auth.DB, func()) {
+		sqlDB, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatalf("unable to open db: %v", err)
+		}
+
+		cleanup := func() {
+			sqlDB.Exec(`DROP TABLE IF EXISTS schema_version, root_keys,
+				nonces, nonce_states, spendings, revoked_tokens,
+				revoked_users, applications`)
+			sqlDB.Close()
+		}
+
+		db, err := New(sqlDB, PostgreSQL, auth.MacaroonLifetime,
+			auth.SystemClock)
+		if err != nil {
+			cleanup()
+			t.Fatalf("unable to create db: %v", err)
+		}
+
+		return db, cleanup
+	})
+}
+
+// TestPostgreSQLConcurrentMigration checks that replicas which are started
+// concurrently don't fail on the schema migration.
+func TestPostgreSQLConcurrentMigration(t *testing.T) {
+	dsn := os.Getenv("SQLDB_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SQLDB_POSTGRES_DSN isn't set")
+	}
+
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	defer func() {
+		sqlDB.Exec(`DROP TABLE IF EXISTS schema_version, root_keys,
+			nonces, nonce_states, spendings, revoked_tokens,
+			revoked_users, applications`)
+		sqlDB.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := New(sqlDB, PostgreSQL, auth.MacaroonLifetime,
+				auth.SystemClock)
+			if err != nil {
+				t.Errorf("unable to create db: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMigrationIdempotence(t *testing.T) {
+	db, cleanup := newSQLiteDB(t)
+	defer cleanup()
+
+	if err := db.PutRootKey([]byte("kek")); err != nil {
+		t.Fatalf("unable to put root key: %v", err)
+	}
+
+	// Emulate the service restart, already applied migrations shouldn't be
+	// applied again and data should be kept.
+	db, err := New(db.db, SQLite, auth.MacaroonLifetime,
+		auth.SystemClock)
+	if err != nil {
+		t.Fatalf("unable to create db: %v", err)
+	}
+
+	if _, err := db.GetRootKey(); err != nil {
+		t.Fatalf("unable to get root key: %v", err)
+	}
+}
+
+func TestConcurrentNonceUsage(t *testing.T) {
+	db, cleanup := newSQLiteDB(t)
+	defer cleanup()
+
+	// Only one of the concurrent requests with the same nonce should pass.
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		passed int
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			used, err := db.UseNonce("app_1", 10, time.Now())
+			if err != nil {
+				t.Errorf("unable to use nonce: %v", err)
+				return
+			}
+
+			if !used {
+				mutex.Lock()
+				passed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if passed != 1 {
+		t.Fatalf("nonce should be accepted once, accepted %v times", passed)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT a FROM b WHERE c = ? AND d = ?`
+
+	if SQLite.rebind(query) != query {
+		t.Fatalf("sqlite query shouldn't be changed")
+	}
+
+	expected := `SELECT a FROM b WHERE c = $1 AND d = $2`
+	if rebound := PostgreSQL.rebind(query); rebound != expected {
+		t.Fatalf("wrong postgres query: %v", rebound)
+	}
+}
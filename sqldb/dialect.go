@@ -0,0 +1,174 @@
+package sqldb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the differences between SQL databases which are
+// supported by DB.
+type Dialect struct {
+	// Name is the name of the dialect.
+	Name string
+
+	// migrations is the list of schema migrations, index of the migration
+	// plus one is the schema version after the migration is applied.
+	migrations []string
+
+	// numberedPlaceholders is true if database uses $1, $2, ...
+	// placeholders instead of question marks.
+	numberedPlaceholders bool
+
+	// returningID is true if id of the inserted row is obtained with
+	// RETURNING clause, otherwise driver should support LastInsertId.
+	returningID bool
+
+	// migrationLock is the query which takes the lock released on the end
+	// of transaction, so that concurrent migrations are serialised. SQLite
+	// doesn't need it because it allows only one writer at a time.
+	migrationLock string
+}
+
+// SQLite is the dialect of SQLite 3.24 or newer.
+var SQLite = &Dialect{
+	Name: "sqlite",
+	migrations: []string{
+		`
+		CREATE TABLE root_keys (
+			id INTEGER PRIMARY KEY,
+			key BLOB NOT NULL,
+			created_at BIGINT NOT NULL,
+			retired_at BIGINT NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE nonces (
+			principal TEXT NOT NULL,
+			nonce BIGINT NOT NULL,
+			keep_until BIGINT NOT NULL,
+			PRIMARY KEY (principal, nonce)
+		);
+
+		CREATE INDEX nonces_keep_until ON nonces (keep_until);
+
+		CREATE TABLE revoked_tokens (
+			token_id TEXT PRIMARY KEY
+		);
+
+		CREATE TABLE revoked_users (
+			user_id TEXT PRIMARY KEY,
+			revoked_before BIGINT NOT NULL
+		);
+
+		CREATE TABLE applications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			description TEXT NOT NULL
+		);
+
+		CREATE INDEX applications_user_id ON applications (user_id);
+		`,
+		`
+		CREATE TABLE nonce_states (
+			principal TEXT PRIMARY KEY,
+			state BLOB NOT NULL
+		);
+		`,
+		`
+		CREATE TABLE spendings (
+			key TEXT PRIMARY KEY,
+			spent BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL
+		);
+
+		CREATE INDEX spendings_expires_at ON spendings (expires_at);
+		`,
+	},
+}
+
+// PostgreSQL is the dialect of PostgreSQL 9.5 or newer.
+var PostgreSQL = &Dialect{
+	Name: "postgres",
+	migrations: []string{
+		`
+		CREATE TABLE root_keys (
+			id BIGINT PRIMARY KEY,
+			key BYTEA NOT NULL,
+			created_at BIGINT NOT NULL,
+			retired_at BIGINT NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE nonces (
+			principal TEXT NOT NULL,
+			nonce BIGINT NOT NULL,
+			keep_until BIGINT NOT NULL,
+			PRIMARY KEY (principal, nonce)
+		);
+
+		CREATE INDEX nonces_keep_until ON nonces (keep_until);
+
+		CREATE TABLE revoked_tokens (
+			token_id TEXT PRIMARY KEY
+		);
+
+		CREATE TABLE revoked_users (
+			user_id TEXT PRIMARY KEY,
+			revoked_before BIGINT NOT NULL
+		);
+
+		CREATE TABLE applications (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			description TEXT NOT NULL
+		);
+
+		CREATE INDEX applications_user_id ON applications (user_id);
+		`,
+		`
+		CREATE TABLE nonce_states (
+			principal TEXT PRIMARY KEY,
+			state BYTEA NOT NULL
+		);
+		`,
+		`
+		CREATE TABLE spendings (
+			key TEXT PRIMARY KEY,
+			spent BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL
+		);
+
+		CREATE INDEX spendings_expires_at ON spendings (expires_at);
+		`,
+	},
+	numberedPlaceholders: true,
+	returningID:          true,
+
+	// Key of the advisory lock is arbitrary, but should be the same for
+	// all replicas.
+	migrationLock: `SELECT pg_advisory_xact_lock(5460817)`,
+}
+
+// rebind converts query written with question mark placeholders in the
+// dialect of the database.
+func (d *Dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
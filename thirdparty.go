@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/macaroon.v2"
+)
+
+// Third-party caveat makes the token valid only together with the discharge
+// macaroon issued by the third-party service, e.g. the 2FA service which
+// confirms the operation with the user. Issuer and third-party service share
+// the secret key, with which the caveat root key and the condition checked
+// by the third-party are encrypted in the caveat id:
+//
+//  caveat id = nonce (24 bytes) || secretbox(root key (32 bytes) || condition)
+//
+// Client sends the caveat id to the third-party service, which decrypts it,
+// checks the condition and issues the discharge macaroon signed with the
+// caveat root key. Discharge is bound to the token by the client before the
+// request, after the nonce and time caveats are added.
+
+const (
+	// thirdPartyNonceSize is the size of secretbox nonce.
+	thirdPartyNonceSize = 24
+
+	// thirdPartyRootKeySize is the size of the caveat root key.
+	thirdPartyRootKeySize = 32
+)
+
+// thirdPartyCaveat is the third-party caveat which should be added to the
+// generated token.
+type thirdPartyCaveat struct {
+	location  string
+	condition string
+}
+
+// isThirdPartyCaveat returns true if caveat should be discharged by the
+// third-party, such caveats don't have key-value representation.
+func isThirdPartyCaveat(c macaroon.Caveat) bool {
+	return len(c.VerificationId) > 0
+}
+
+// ThirdPartyKey registers the secret key shared with the third-party service
+// located at the given location, it is needed to add third-party caveats to
+// the generated tokens.
+func ThirdPartyKey(location string, key *[32]byte) Option {
+	return func(a *Auth) {
+		a.thirdPartyKeys[location] = key
+	}
+}
+
+// addThirdPartyCaveat adds the caveat which requires the discharge from the
+// third-party service located at the given location.
+func addThirdPartyCaveat(m *macaroon.Macaroon, key *[32]byte, location,
+	condition string) (*macaroon.Macaroon, error) {
+
+	var nonce [thirdPartyNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	rootKey := make([]byte, thirdPartyRootKeySize)
+	if _, err := rand.Read(rootKey); err != nil {
+		return nil, err
+	}
+
+	plaintext := append(rootKey, condition...)
+	caveatID := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+
+	newMac := m.Clone()
+	err := newMac.AddThirdPartyCaveat(rootKey, caveatID, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMac, nil
+}
+
+// ThirdPartyCaveatIDs returns the hex encoded ids of third-party caveats of
+// the macaroon by their locations, client should obtain the discharge for
+// every of them.
+func ThirdPartyCaveatIDs(m *macaroon.Macaroon) map[string][]string {
+	ids := make(map[string][]string)
+	for _, c := range m.Caveats() {
+		if isThirdPartyCaveat(c) {
+			ids[c.Location] = append(ids[c.Location], hex.EncodeToString(c.Id))
+		}
+	}
+
+	return ids
+}
+
+// BindDischarges is used by the client application to bind the discharge
+// macaroons to the token before making the request. Discharges should be
+// bound after all other caveats, such as nonce and time, are added, because
+// binding depends on the token signature.
+func BindDischarges(m *macaroon.Macaroon,
+	discharges ...*macaroon.Macaroon) macaroon.Slice {
+
+	ms := macaroon.Slice{m}
+	for _, d := range discharges {
+		bound := d.Clone()
+		bound.Bind(m.Signature())
+		ms = append(ms, bound)
+	}
+
+	return ms
+}
+
+// checkDischarges checks that discharges are used within their validity
+// period. Discharge might contain only time restrictions, other first-party
+// caveats are not enforced for discharges and therefore are rejected.
+func checkDischarges(discharges []*macaroon.Macaroon, now time.Time) error {
+	for _, d := range discharges {
+		fields, err := caveatsToMap(d.Caveats())
+		if err != nil {
+			return err
+		}
+
+		for key := range fields {
+			if key != ExpiresPrefix && key != NotBeforePrefix {
+				return ErrUnknownCaveat
+			}
+		}
+
+		if err := checkValidityPeriod(d, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Discharger is used by the third-party service to issue discharge
+// macaroons for the third-party caveats of tokens.
+type Discharger struct {
+	location string
+	key      *[32]byte
+	lifetime time.Duration
+	clock    Clock
+	check    func(ctx context.Context, condition string) error
+}
+
+// NewDischarger creates the discharger of the third-party service located at
+// the given location. Check function is called with the condition of the
+// caveat and should return an error if discharge shouldn't be issued.
+// Discharges are valid for the given lifetime, zero means forever.
+func NewDischarger(location string, key *[32]byte, lifetime time.Duration,
+	check func(ctx context.Context, condition string) error) *Discharger {
+
+	return &Discharger{
+		location: location,
+		key:      key,
+		lifetime: lifetime,
+		clock:    SystemClock,
+		check:    check,
+	}
+}
+
+// Discharge checks the condition of the third-party caveat with the given
+// hex encoded id and issues the discharge macaroon for it.
+func (d *Discharger) Discharge(ctx context.Context,
+	caveatID string) (*macaroon.Macaroon, error) {
+
+	id, err := hex.DecodeString(caveatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) < thirdPartyNonceSize {
+		return nil, errors.Errorf("malformed caveat id")
+	}
+
+	var nonce [thirdPartyNonceSize]byte
+	copy(nonce[:], id)
+
+	plaintext, ok := secretbox.Open(nil, id[thirdPartyNonceSize:], &nonce,
+		d.key)
+	if !ok || len(plaintext) < thirdPartyRootKeySize {
+		return nil, errors.Errorf("unable to decrypt caveat id")
+	}
+
+	rootKey := plaintext[:thirdPartyRootKeySize]
+	condition := string(plaintext[thirdPartyRootKeySize:])
+
+	if err := d.check(ctx, condition); err != nil {
+		return nil, err
+	}
+
+	m, err := macaroon.New(rootKey, id, d.location, macaroon.LatestVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.lifetime != 0 {
+		return AddExpiration(m, d.clock.Now().Add(d.lifetime))
+	}
+
+	return m, nil
+}
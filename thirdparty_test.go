@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/macaroon.v2"
+)
+
+func TestThirdPartyCaveat(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	location := "2fa.bitlum.io"
+
+	clock := NewFakeClock(time.Now())
+	db := NewInMemoryDBWithClock([]byte("kek"), MacaroonLifetime, clock)
+	auth, err := NewAuth("", db, TimeSource(clock),
+		ThirdPartyKey(location, key))
+	if err != nil {
+		t.Fatalf("unable to create auth: %v", err)
+	}
+
+	appID := registerApplication(t, auth, "100")
+	tokenStr, err := auth.GenerateToken("100", appID, nil,
+		ThirdPartyCaveat(location, "confirm withdraw"))
+	if err != nil {
+		t.Fatalf("unable to generate macaroon token: %v", err)
+	}
+
+	// Second factor service confirms only withdrawals.
+	errNotConfirmed := errors.Errorf("operation not confirmed")
+	discharger := NewDischarger(location, key, time.Hour,
+		func(ctx context.Context, condition string) error {
+			if condition != "confirm withdraw" {
+				return errNotConfirmed
+			}
+			return nil
+		})
+
+	// fresh emulates the client which adds nonce and time caveats, and
+	// binds the discharges.
+	fresh := func(nonce int64, discharges ...*macaroon.Macaroon) string {
+		m, err := DecodeMacaroon(tokenStr)
+		if err != nil {
+			t.Fatalf("unable to decode macaroon: %v", err)
+		}
+
+		m, err = AddNonce(m, nonce)
+		if err != nil {
+			t.Fatalf("unable to add nonce: %v", err)
+		}
+
+		m, err = AddCurrentTimeFrom(m, clock)
+		if err != nil {
+			t.Fatalf("unable to add current time: %v", err)
+		}
+
+		freshStr, err := EncodeMacaroons(BindDischarges(m, discharges...))
+		if err != nil {
+			t.Fatalf("unable to encode macaroons: %v", err)
+		}
+
+		return freshStr
+	}
+
+	m, err := DecodeMacaroon(tokenStr)
+	if err != nil {
+		t.Fatalf("unable to decode macaroon: %v", err)
+	}
+
+	ids := ThirdPartyCaveatIDs(m)[location]
+	if len(ids) != 1 {
+		t.Fatalf("wrong number of third-party caveats: %v", len(ids))
+	}
+
+	discharge, err := discharger.Discharge(context.Background(), ids[0])
+	if err != nil {
+		t.Fatalf("unable to discharge caveat: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(fresh(1)); err == nil {
+		t.Fatalf("token without discharge should be rejected")
+	}
+
+	if _, err := auth.ExtractToken(fresh(2, discharge)); err != nil {
+		t.Fatalf("token with discharge should be accepted: %v", err)
+	}
+
+	// Discharge which is not bound to the token couldn't be used.
+	unbound, err := EncodeMacaroons(macaroon.Slice{m, discharge})
+	if err != nil {
+		t.Fatalf("unable to encode macaroons: %v", err)
+	}
+
+	if _, err := auth.ExtractToken(addFreshness(t, unbound, 3)); err == nil {
+		t.Fatalf("token with unbound discharge should be rejected")
+	}
+
+	// Discharger uses the system clock, so we move our clock further than
+	// the discharge lifetime.
+	clock.Advance(2 * time.Hour)
+	_, err = auth.ExtractToken(fresh(4, discharge))
+	if err != ErrTokenExpired {
+		t.Fatalf("expired discharge should be rejected: %v", err)
+	}
+
+	// Discharger checks the condition of the caveat.
+	otherDischarger := NewDischarger(location, key, 0,
+		func(ctx context.Context, condition string) error {
+			return errNotConfirmed
+		})
+
+	_, err = otherDischarger.Discharge(context.Background(), ids[0])
+	if err != errNotConfirmed {
+		t.Fatalf("discharge should be refused: %v", err)
+	}
+
+	// Discharger with other key couldn't decrypt the caveat.
+	otherDischarger = NewDischarger(location, &[32]byte{}, 0,
+		func(ctx context.Context, condition string) error {
+			return nil
+		})
+
+	if _, err := otherDischarger.Discharge(context.Background(),
+		ids[0]); err == nil {
+		t.Fatalf("caveat encrypted with other key should be rejected")
+	}
+
+	_, err = auth.GenerateToken("100", appID, nil,
+		ThirdPartyCaveat("unknown.io", "confirm"))
+	if err != ErrThirdPartyNotFound {
+		t.Fatalf("unknown third-party should be rejected: %v", err)
+	}
+}
@@ -1,14 +1,40 @@
 package auth
 
 import (
-	"encoding/binary"
+	"context"
+	"encoding/hex"
+	"time"
 	"github.com/go-errors/errors"
 	"gopkg.in/macaroon.v2"
 )
 
 type Token struct {
-	macaroon *macaroon.Macaroon
-	userID   uint32
+	macaroon      *macaroon.Macaroon
+	applicationID uint32
+	userID        UserID
+	id            string
+	principal     string
+	keyID         uint32
+	issuedAt      time.Time
+
+	// tokenID and lineage are the raw ids of the token and tokens from
+	// which it has been issued.
+	tokenID []byte
+	lineage [][]byte
+
+	// lineageQuotas is the number of daily quotas introduced by every token
+	// of the lineage.
+	lineageQuotas []uint32
+
+	// auth is used to track spendings of the token.
+	auth *Auth
+
+	// ctx is the context of the request with which token has been
+	// extracted, it is passed to the caveat checkers on authorization.
+	ctx context.Context
+
+	// caveats are the application-specific caveats of the token.
+	caveats []tokenCaveat
 }
 
 // ExtractToken checks that the given token represent the subset of macaroon
@@ -16,55 +42,189 @@ type Token struct {
 // but client is responsible for adding them to ensure that even if token
 // will be intercepted by an attacker he/she couldn't use it for replay attack.
 func (a *Auth) ExtractToken(tokenStr string) (*Token, error) {
+	return a.ExtractTokenContext(context.Background(), tokenStr)
+}
+
+// ExtractTokenContext is the same as ExtractToken but also passes the context
+// of the request to the registered caveat checkers.
+func (a *Auth) ExtractTokenContext(ctx context.Context,
+	tokenStr string) (*Token, error) {
+
 	if tokenStr == "" {
 		return nil, errors.Errorf("token not found")
 	}
 
 	// With the macaroon obtained, we'll now decode the hex-string
 	// encoding, then unmarshal it from binary into its concrete struct
-	// representation.
-	m, err := DecodeMacaroon(tokenStr)
+	// representation. Token might be followed by the discharge macaroons
+	// of its third-party caveats.
+	ms, err := DecodeMacaroons(tokenStr)
 	if err != nil {
 		return nil, errors.Errorf("unable to decode macaroon: %v", err)
 	}
+	m, discharges := ms[0], ms[1:]
+
+	id, err := decodeIdentifier(m.Id())
+	if err != nil {
+		return nil, err
+	}
+
+	// Select the root key by the key id stored in the macaroon id, so that
+	// tokens signed with previous keys remain valid after key rotation.
+	rootKey, err := a.getVerificationKey(id)
+	if err != nil {
+		return nil, err
+	}
 
-	// Checks that signature is haven't bee tempered with. Note that we pass
-	// empty checker because we do the manual caveat validation.
-	emptyCheck := func(_ string) error { return nil }
-	if err := m.Verify(a.rootKey, emptyCheck, nil); err != nil {
+	// Checks that signature is haven't bee tempered with, that every
+	// third-party caveat is discharged and that token contains only known
+	// and well-formed caveats, caveat semantic is validated manually
+	// afterwards.
+	if err := m.Verify(rootKey.Key, a.checkCaveat, discharges); err != nil {
 		return nil, err
 	}
 
-	// TODO(andrew.shvv) Use application id instead,
-	// but that would require some form of database.
-	userID := binary.BigEndian.Uint32(m.Id())
+	// Check that token and discharges are used within validity period given
+	// on their generation.
+	if err := checkValidityPeriod(m, a.clock.Now()); err != nil {
+		return nil, err
+	}
+
+	if err := checkDischarges(discharges, a.clock.Now()); err != nil {
+		return nil, err
+	}
+
+	// Check that request has been made from the allowed network.
+	if err := checkPeerAddress(ctx, m); err != nil {
+		return nil, err
+	}
+
+	// Check that token is used for the request to which client has bound
+	// it.
+	err = checkRequestBinding(ctx, m, a.requireRequestBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that neither token itself nor all tokens of the user have been
+	// revoked.
+	if err := a.checkRevocation(id); err != nil {
+		return nil, err
+	}
 
 	// Check that token has expired and that nonce is greater than previous
 	// one used by application.
-	if err := CheckNonce(m, userID, a.db, MacaroonLifetime); err != nil {
+	lifetime, err := requestLifetime(m, a.lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceChecker := &NonceChecker{
+		DB:         a.db,
+		Lifetime:   lifetime,
+		Mode:       a.replayMode,
+		WindowSize: a.nonceWindowSize,
+		Clock:      a.clock,
+		MaxSkew:    a.maxClockSkew,
+	}
+	if err := nonceChecker.Check(m, id.principal()); err != nil {
+		return nil, err
+	}
+
+	caveats, err := a.registeredCaveats(m.Caveats())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegisteredCaveats(ctx, caveats); err != nil {
 		return nil, err
 	}
 
 	return &Token{
-		macaroon: m,
-		userID:   userID,
+		macaroon:      m,
+		applicationID: id.applicationID,
+		userID:        id.userID,
+		id:            id.tokenIDString(),
+		principal:     id.principal(),
+		keyID:         id.keyID,
+		issuedAt:      id.issuedAt,
+		tokenID:       id.tokenID,
+		lineage:       id.lineage,
+		lineageQuotas: id.lineageQuotas,
+		auth:          a,
+		ctx:           ctx,
+		caveats:       caveats,
 	}, nil
 }
 
 // IsAuthorized checks that the given token is authorized to make given
-// operation.
+// operation. Token which is restricted to the particular resources is not
+// authorized to make any operation without resource, use IsAuthorizedFor.
 func (t *Token) IsAuthorized(operation string) error {
-	// Check that operation application wants to access is not disabled in the
-	// token.
+	return t.isAuthorized(ContextWithOperation(t.ctx, operation), operation,
+		"")
+}
+
+// IsAuthorizedFor checks that the given token is authorized to make given
+// operation on the given resource, e.g. sub-account or wallet.
+func (t *Token) IsAuthorizedFor(operation, resource string) error {
+	ctx := ContextWithOperation(t.ctx, operation)
+	ctx = context.WithValue(ctx, resourceKey{}, resource)
+	return t.isAuthorized(ctx, operation, resource)
+}
+
+func (t *Token) isAuthorized(ctx context.Context, operation,
+	resource string) error {
+
+	// Check that operation application wants to access is allowed and not
+	// disabled in the token.
 	if !IsOperationAllowed(t.macaroon, operation) {
 		return ErrOperNotAllowed
 	}
 
-	return nil
+	if !IsResourceAllowed(t.macaroon, resource) {
+		return ErrResourceNotAllowed
+	}
+
+	// Check application-specific caveats, which might depend on operation.
+	return checkRegisteredCaveats(ctx, t.caveats)
+}
+
+// ApplicationID returns the id of the application for which token was issued.
+// Legacy tokens are not bound to the application and have zero id.
+func (t *Token) ApplicationID() uint32 {
+	return t.applicationID
 }
 
 // UserID returns the user id which was originally stored in the macaroon
 // payload.
-func (t *Token) UserID() uint32 {
+func (t *Token) UserID() UserID {
 	return t.userID
 }
+
+// ID returns the unique token id, which might be used to revoke the token.
+// Tokens issued before revocation has been introduced have empty id.
+func (t *Token) ID() string {
+	return t.id
+}
+
+// KeyID returns the id of the root key with which token has been signed.
+func (t *Token) KeyID() uint32 {
+	return t.keyID
+}
+
+// IssuedAt returns the time when token has been generated. Legacy tokens do
+// not have the issue time and zero time is returned.
+func (t *Token) IssuedAt() time.Time {
+	return t.issuedAt
+}
+
+// ParentID returns the id of the token with which this token has been
+// issued, empty id is returned if token has been generated by the server.
+func (t *Token) ParentID() string {
+	if len(t.lineage) == 0 {
+		return ""
+	}
+
+	return hex.EncodeToString(t.lineage[0])
+}